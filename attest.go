@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Attestations are what we said about a checksum file, signed, so that a
+// client can show later what we said. They are DSSE envelopes
+// (github.com/secure-systems-lab/dsse) holding a Statement.
+const (
+	statementType = "https://github.com/aerth/checksigd/statement/v1"
+	payloadType   = "application/vnd.checksigd.statement+json"
+)
+
+// Envelope is a DSSE envelope: a payload and signatures over its PAE.
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is a signature in an Envelope. KeyID is the hex key
+// number of the signify public key at /.well-known/checksigd.pub.
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// Statement is what we attest to.
+type Statement struct {
+	Type     string    `json:"_type"`
+	URL      string    `json:"url"`
+	FinalURL string    `json:"final_url"`
+	Fetched  time.Time `json:"fetched"` // when upstream last gave it to us
+	Digest   string    `json:"sha256"`  // of the checksum file as we read it
+	Entries  []Entry   `json:"entries"`
+	Verdict  Verdict   `json:"verdict"`
+	Issued   time.Time `json:"issued"`
+	Nonce    string    `json:"nonce,omitempty"` // the client's, to show it is not an old statement
+}
+
+// Verdict is what we made of the signatures and artifact.
+type Verdict struct {
+	Truncated bool   `json:"truncated,omitempty"`
+	Signature string `json:"signature"` // valid, invalid or none
+	Signer    string `json:"signer,omitempty"`
+
+	Artifact        string            `json:"artifact"` // match, mismatch or none
+	ArtifactURL     string            `json:"artifact_url,omitempty"`
+	ArtifactDigests map[string]string `json:"artifact_digests,omitempty"`
+	ArtifactSigned  string            `json:"artifact_signature,omitempty"` // valid or invalid
+
+	Peers string `json:"peers,omitempty"` // agree, disagree or unavailable
+}
+
+// pae is the DSSE pre-authentication encoding of payload, what is signed.
+func pae(typ string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(typ), typ, len(payload))), payload...)
+}
+
+// verdictOf a signature: valid, invalid or none, and who signed it.
+func verdictOf(sig *Signature) (string, string) {
+	switch {
+	case sig == nil:
+		return "none", ""
+	case !sig.Valid:
+		return "invalid", ""
+	case sig.Fingerprint != "":
+		return "valid", sig.Fingerprint
+	}
+	return "valid", sig.KeyID
+}
+
+// attest signs a Statement of what resp says about the checksum file cf.
+func attest(resp *HashResponse, cf *checksumFile, nonce string) (*Envelope, error) {
+	st := Statement{
+		Nonce:    nonce,
+		Type:     statementType,
+		URL:      resp.URL,
+		FinalURL: resp.FinalURL,
+		Fetched:  cf.Fetched,
+		Digest:   cf.Digest,
+		Entries:  resp.Entries,
+		Issued:   time.Now().UTC(),
+	}
+	st.Verdict.Truncated = resp.Truncated
+	st.Verdict.Signature, st.Verdict.Signer = verdictOf(resp.Signature)
+	st.Verdict.Artifact = "none"
+	if v := resp.Verification; v != nil {
+		st.Verdict.Artifact = "mismatch"
+		if v.Match {
+			st.Verdict.Artifact = "match"
+		}
+		st.Verdict.ArtifactURL = v.Artifact
+		st.Verdict.ArtifactDigests = v.Digests
+		if v.Signature != nil {
+			st.Verdict.ArtifactSigned, _ = verdictOf(v.Signature)
+		}
+	}
+
+	if resp.Peers != nil {
+		st.Verdict.Peers = resp.Peers.Verdict
+	}
+
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	num := keyNum(nodeKey.Public().(ed25519.PublicKey))
+	return &Envelope{
+		PayloadType: payloadType,
+		Payload:     payload,
+		Signatures: []EnvelopeSignature{{
+			KeyID: hex.EncodeToString(num[:]),
+			Sig:   ed25519.Sign(nodeKey, pae(payloadType, payload)),
+		}},
+	}, nil
+}
+
+// Open returns the Statement in e, which must be signed by pub. With no
+// pub, it is returned unchecked.
+func (e *Envelope) Open(pub ed25519.PublicKey) (*Statement, error) {
+	if e.PayloadType != payloadType {
+		return nil, fmt.Errorf("not a statement but %q", e.PayloadType)
+	}
+	if pub != nil {
+		signed := false
+		for _, sig := range e.Signatures {
+			if ed25519.Verify(pub, pae(e.PayloadType, e.Payload), sig.Sig) {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, errors.New("statement not signed by the pinned key")
+		}
+	}
+	st := new(Statement)
+	if err := json.Unmarshal(e.Payload, st); err != nil {
+		return nil, err
+	}
+	if st.Type != statementType {
+		return nil, fmt.Errorf("unknown statement type %q", st.Type)
+	}
+	return st, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// maxBatchItems is the most items a batch may have.
+const maxBatchItems = 1000
+
+// BatchResult is the answer to one item of a batch, a line of the
+// response. Index is where the item was in the batch; ID is its "id", if
+// it had one.
+type BatchResult struct {
+	Index  int           `json:"index"`
+	ID     string        `json:"id,omitempty"`
+	Result *HashResponse `json:"result,omitempty"`
+	Error  *APIError     `json:"error,omitempty"`
+}
+
+// readBatch reads the items of a batch, a JSON array of objects or one
+// object per line, each holding the values a POST to / takes.
+func readBatch(r io.Reader) ([]url.Values, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil, fmt.Errorf("no items")
+	} else if err != nil {
+		return nil, err
+	}
+	var raw []map[string]interface{}
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			var item map[string]interface{}
+			if err := dec.Decode(&item); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if raw = append(raw, item); len(raw) > maxBatchItems {
+				break
+			}
+		}
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no items")
+	}
+	if len(raw) > maxBatchItems {
+		return nil, fmt.Errorf("over %d items", maxBatchItems)
+	}
+
+	items := make([]url.Values, len(raw))
+	for i, item := range raw {
+		items[i] = url.Values{}
+		for k, v := range item {
+			switch v := v.(type) {
+			case string:
+				items[i].Set(k, v)
+			case float64:
+				items[i].Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				items[i].Set(k, strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("item %d: %s is not a string, number or bool", i, k)
+			}
+		}
+	}
+	return items, nil
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		br.Discard(1)
+	}
+}
+
+// hostLimiter bounds how many fetches run at once per host, across every
+// batch.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+type hostSlots struct {
+	sem   chan struct{}
+	users int // holding or waiting for a slot
+}
+
+// batchHosts limits batches, and discovery's probes, to -batch-per-host
+// fetches from any one host.
+var batchHosts = &hostLimiter{hosts: map[string]*hostSlots{}}
+
+// acquire waits for a slot on each of hosts, in order so that two callers
+// cannot each hold what the other waits for, and returns the func that
+// gives them back.
+func (l *hostLimiter) acquire(ctx context.Context, hosts []string) (release func(), err error) {
+	sort.Strings(hosts)
+	var held []string
+	release = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, h := range held {
+			s := l.hosts[h]
+			<-s.sem
+			if s.users--; s.users == 0 {
+				delete(l.hosts, h)
+			}
+		}
+	}
+	for i, h := range hosts {
+		if i > 0 && h == hosts[i-1] {
+			continue
+		}
+		l.mu.Lock()
+		s := l.hosts[h]
+		if s == nil {
+			s = &hostSlots{sem: make(chan struct{}, *batchperhost)}
+			l.hosts[h] = s
+		}
+		s.users++
+		l.mu.Unlock()
+
+		select {
+		case s.sem <- struct{}{}:
+			held = append(held, h)
+		case <-ctx.Done():
+			l.mu.Lock()
+			if s.users--; s.users == 0 {
+				delete(l.hosts, h)
+			}
+			l.mu.Unlock()
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+type heldHostsKey struct{}
+
+// withHeldHosts returns a context under which hosts are known to be held,
+// so that probe does not wait for a slot it holds itself.
+func withHeldHosts(ctx context.Context, hosts []string) context.Context {
+	return context.WithValue(ctx, heldHostsKey{}, hosts)
+}
+
+// heldHosts are the hosts the caller holds slots on, if any.
+func heldHosts(ctx context.Context) []string {
+	hosts, _ := ctx.Value(heldHostsKey{}).([]string)
+	return hosts
+}
+
+// hostsOf are the hosts req fetches from first: its checksum file and
+// artifact.
+func hostsOf(req *HashRequest) []string {
+	var hosts []string
+	for _, u := range []*url.URL{req.URL, req.Artifact} {
+		if u != nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// BatchHandler takes a list of items, each what a POST to / takes, and
+// streams back a BatchResult for each as JSON lines, as they are done.
+// -batch-workers items are worked on at once, no more than
+// -batch-per-host of them fetching from any one host.
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	limits := limitsFor(r.URL.Path)
+	items, err := readBatch(http.MaxBytesReader(w, r.Body, limits.Body))
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, "batch: "+err.Error()))
+		return
+	}
+	log.Printf("BATCH: %d items from %s - %s", len(items), r.RemoteAddr, r.UserAgent())
+
+	ctx := r.Context()
+	todo := make(chan int)
+	done := make(chan BatchResult)
+	workers := *batchworkers
+	if workers > len(items) {
+		workers = len(items)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				done <- batchItem(ctx, i, items[i], limits)
+			}
+		}()
+	}
+	go func() {
+		defer close(todo)
+		for i := range items {
+			select {
+			case todo <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	ok := 0
+	for res := range done {
+		if ctx.Err() != nil {
+			continue // drain, the client is gone
+		}
+		if res.Error == nil {
+			ok++
+		}
+		if err := enc.Encode(res); err != nil {
+			log.Println(err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if ctx.Err() != nil {
+		log.Println(errClientGone)
+		return
+	}
+	log.Printf("Batch done: %d of %d items", ok, len(items))
+}
+
+// batchItem does item i of a batch as HashHandler would.
+func batchItem(ctx context.Context, i int, item url.Values, limits Limits) BatchResult {
+	res := BatchResult{Index: i, ID: item.Get("id")}
+	fail := func(err error) BatchResult {
+		var e *APIError
+		if !errors.As(err, &e) {
+			e = newAPIError(http.StatusInternalServerError, CodeInternal, err.Error())
+		}
+		res.Error = e
+		return res
+	}
+
+	// The item is a form, as if posted by itself
+	req, err := parseHashRequest(&http.Request{Form: item, PostForm: item}, limits)
+	if err != nil {
+		return fail(err)
+	}
+	hosts := hostsOf(req)
+	release, err := batchHosts.acquire(ctx, hosts)
+	if err != nil {
+		return fail(upstreamError(fetchErr(ctx, err)))
+	}
+	defer release()
+	if res.Result, err = requester.Do(withHeldHosts(ctx, hosts), req); err != nil {
+		return fail(err)
+	}
+	return res
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheInfo tells a client how old what we served them is.
+type CacheInfo struct {
+	Hit         bool      `json:"hit"`                   // served from our cache
+	Revalidated bool      `json:"revalidated,omitempty"` // after upstream said it had not changed
+	Fetched     time.Time `json:"fetched"`               // when we last got it from upstream
+	Validated   time.Time `json:"validated"`             // when upstream last said it was current
+	Age         int64     `json:"age"`                   // seconds since validated
+}
+
+// cacheEntry is a file we fetched, up to the limit it was fetched with.
+type cacheEntry struct {
+	Key          string    `json:"key"`
+	FinalURL     string    `json:"final_url"`
+	Redirects    []Hop     `json:"redirects,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Body         []byte    `json:"body"`
+	Complete     bool      `json:"complete"` // Body is all of it
+	Fetched      time.Time `json:"fetched"`
+	Validated    time.Time `json:"validated"`
+}
+
+// usable reports whether e holds enough of the file to read limit bytes
+// and one more, as we do to tell if a file is larger than limit.
+func (e *cacheEntry) usable(limit int64) bool {
+	return e.Complete || int64(len(e.Body)) > limit
+}
+
+// response is e as if upstream just sent it.
+func (e *cacheEntry) response() *http.Response {
+	u, _ := url.Parse(e.FinalURL)
+	h := http.Header{}
+	for k, v := range map[string]string{"Content-Type": e.ContentType, "Etag": e.ETag, "Last-Modified": e.LastModified} {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     h,
+		Body:       ioutil.NopCloser(bytes.NewReader(e.Body)),
+		Request:    &http.Request{Method: "GET", URL: u},
+	}
+}
+
+func (e *cacheEntry) info(hit, revalidated bool) *CacheInfo {
+	return &CacheInfo{hit, revalidated, e.Fetched, e.Validated, int64(time.Since(e.Validated) / time.Second)}
+}
+
+// maxcachefile is the largest file we cache. Larger ones are read as they
+// come, as if there were no cache.
+const maxcachefile = 1 << 20
+
+// Cache holds the checksum and signature files we fetched, by URL, for
+// ttl before asking upstream whether they changed. It holds at most size
+// files and maxbytes of them, forgetting the least recently used, and only
+// whole files of up to maxcachefile. With a dir, it keeps them there too,
+// to survive restarts.
+type Cache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	size     int
+	maxbytes int64
+	maxfile  int64 // largest file we keep
+	bytes    int64 // of bodies held
+	dir      string
+	lru      *list.List // of *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+}
+
+// cache serves HashHandler. It is nil, caching nothing, unless enabled
+// by flags.
+var cache *Cache
+
+// NewCache returns a cache, loading whatever is in dir.
+func NewCache(size int, maxbytes int64, ttl time.Duration, dir string) (*Cache, error) {
+	c := &Cache{ttl: ttl, size: size, maxbytes: maxbytes, maxfile: maxcachefile, dir: dir, lru: list.New(), entries: map[string]*list.Element{}}
+	if c.maxfile > maxbytes {
+		c.maxfile = maxbytes
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*cacheEntry
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		e := new(cacheEntry)
+		if err := json.Unmarshal(b, e); err != nil || e.Key == "" || !e.Complete || int64(len(e.Body)) > c.maxfile {
+			log.Println("cache: dropping", f, err)
+			os.Remove(f)
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	// Oldest first, so the newest end up most recently used
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Validated.Before(loaded[j].Validated) })
+	for _, e := range loaded {
+		c.store(e)
+	}
+	return c, nil
+}
+
+// cacheKey is u in canonical form: the same file whichever way its URL
+// is written.
+func cacheKey(u *url.URL) string {
+	k := *u
+	k.Scheme = strings.ToLower(k.Scheme)
+	k.Host = strings.ToLower(k.Host)
+	if port := k.Port(); (k.Scheme == "http" && port == "80") || (k.Scheme == "https" && port == "443") {
+		k.Host = k.Hostname()
+	}
+	if k.Path == "" {
+		k.Path = "/"
+	}
+	k.Fragment = ""
+	k.RawFragment = ""
+	k.User = nil
+	return k.String()
+}
+
+// filename is where key is kept in dir.
+func (c *Cache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// forget drops key, if we have it.
+func (c *Cache) forget(key string) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.bytes -= int64(len(el.Value.(*cacheEntry).Body))
+	}
+	c.mu.Unlock()
+	if ok && c.dir != "" {
+		os.Remove(c.filename(key))
+	}
+}
+
+func (c *Cache) lookup(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// store adds or replaces e, which must not change after, and forgets the
+// least recently used entries over size or maxbytes.
+func (c *Cache) store(e *cacheEntry) {
+	c.mu.Lock()
+	if el, ok := c.entries[e.Key]; ok {
+		c.bytes -= int64(len(el.Value.(*cacheEntry).Body))
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[e.Key] = c.lru.PushFront(e)
+	}
+	c.bytes += int64(len(e.Body))
+	var evicted []string
+	for c.lru.Len() > c.size || c.bytes > c.maxbytes {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.Key)
+		c.bytes -= int64(len(old.Body))
+		evicted = append(evicted, old.Key)
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	for _, key := range evicted {
+		os.Remove(c.filename(key))
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println("cache:", err)
+		return
+	}
+	name := c.filename(e.Key)
+	if err := ioutil.WriteFile(name+".tmp", b, 0600); err != nil {
+		log.Println("cache:", err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.Println("cache:", err)
+	}
+}
+
+// Get gets u as get does, from the cache if we have it and it is fresh. A
+// stale copy is revalidated with If-None-Match and If-Modified-Since; so is
+// a fresh one if revalidate. Only whole 200 responses of up to limit bytes
+// and maxfile are cached, and the CacheInfo is nil for anything else,
+// whose body is read as it comes. A nil cache just gets u.
+func (c *Cache) Get(ctx context.Context, u *url.URL, d Deadlines, limit int64, revalidate bool) (*http.Response, *CacheInfo, error) {
+	if c == nil {
+		resp, err := get(ctx, u, d)
+		return resp, nil, err
+	}
+	rd, _ := ctx.Value(redirectsKey{}).(*redirects)
+
+	// What we have, if the request could have got it
+	key := cacheKey(u)
+	e := c.lookup(key)
+	if e != nil && (!e.usable(limit) || rd != nil && !rd.policy.allows(e.Redirects, e.FinalURL)) {
+		e = nil
+	}
+	if e != nil && !revalidate && time.Since(e.Validated) < c.ttl {
+		if rd != nil {
+			rd.hops = e.Redirects
+		}
+		return e.response(), e.info(true, false), nil
+	}
+
+	h := http.Header{}
+	if e != nil && e.ETag != "" {
+		h.Set("If-None-Match", e.ETag)
+	}
+	if e != nil && e.LastModified != "" {
+		h.Set("If-Modified-Since", e.LastModified)
+	}
+	resp, err := getIf(ctx, u, d, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+
+	// Still the same
+	if resp.StatusCode == http.StatusNotModified && e != nil {
+		resp.Body.Close()
+		fresh := *e
+		fresh.Validated = now
+		fresh.Redirects = rd.Hops()
+		c.store(&fresh)
+		return fresh.response(), fresh.info(true, true), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+
+	// Read what we might keep; past that, hand on what we read and the
+	// rest as it comes
+	keep := c.maxfile
+	if limit < keep {
+		keep = limit
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, keep+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if int64(len(body)) > keep {
+		c.forget(key)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil, nil
+	}
+	resp.Body.Close()
+	e = &cacheEntry{
+		Key:          key,
+		FinalURL:     resp.Request.URL.String(),
+		Redirects:    rd.Hops(),
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("Etag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+		Complete:     true,
+		Fetched:      now,
+		Validated:    now,
+	}
+	if !strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-store") {
+		c.store(e)
+	}
+	return e.response(), e.info(false, false), nil
+}
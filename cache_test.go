@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsByBytes(t *testing.T) {
+	c, err := NewCache(10, 100, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		c.store(&cacheEntry{Key: k, Body: make([]byte, 40), Complete: true})
+	}
+	if c.lookup("a") != nil || c.lookup("b") == nil || c.lookup("c") == nil {
+		t.Error("least recently used entry not evicted over maxbytes")
+	}
+	if c.bytes != 80 {
+		t.Errorf("bytes %d, want 80", c.bytes)
+	}
+	c.store(&cacheEntry{Key: "b", Body: make([]byte, 10), Complete: true})
+	c.forget("c")
+	if c.bytes != 10 || c.lru.Len() != 1 {
+		t.Errorf("bytes %d in %d entries, want 10 in 1", c.bytes, c.lru.Len())
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	bodies := map[string]string{
+		"/small": "small file\n",
+		"/large": strings.Repeat("x", 64),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	c, err := NewCache(10, 32, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		path   string
+		limit  int64
+		cached bool
+	}{
+		{"whole", "/small", 1 << 20, true},
+		{"over maxfile", "/large", 1 << 20, false},
+		{"cut at the limit", "/small", 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := mustParse(t, srv.URL+tt.path)
+			c.forget(cacheKey(u))
+			resp, info, err := c.Get(context.Background(), u, Deadlines{}, tt.limit, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != bodies[tt.path] {
+				t.Errorf("body %q, want %q", b, bodies[tt.path])
+			}
+			if cached := c.lookup(cacheKey(u)) != nil; cached != tt.cached {
+				t.Errorf("cached %v, want %v", cached, tt.cached)
+			}
+			if (info != nil) != tt.cached {
+				t.Errorf("cache info %+v", info)
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Entry is a single digest published in a checksum file.
+type Entry struct {
+	Algorithm string `json:"algorithm"`
+	Filename  string `json:"filename,omitempty"`
+	Digest    string `json:"digest"`
+	Line      int    `json:"line,omitempty"`
+
+	// Confidence is how sure we are of an entry extracted from an HTML
+	// page, from 0 to 1.
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// LineError reports a line of a checksum file that could not be parsed.
+type LineError struct {
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Reason, e.Text)
+}
+
+// maxlinesize is the longest line we will consider when parsing.
+const maxlinesize = 4096
+
+// hexsizes maps the length of a hex digest to the algorithm we assume made
+// it, when the checksum file does not say.
+var hexsizes = map[int]string{
+	32:  "MD5",
+	40:  "SHA1",
+	56:  "SHA224",
+	64:  "SHA256",
+	96:  "SHA384",
+	128: "SHA512",
+}
+
+var (
+	// MD5 (file) = hash, and openssl's SHA256(file)= hash
+	bsdline = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9/-]*) ?\((.*)\) ?= ?([0-9A-Fa-f]+)$`)
+	// hash  file, hash *file
+	gnuline = regexp.MustCompile(`^\\?([0-9A-Fa-f]+)[ \t]+\*?(.+)$`)
+	// hash
+	hexline = regexp.MustCompile(`^[0-9A-Fa-f]+$`)
+
+	// Field: value, as in Debian Release files and Helm provenance files
+	fieldline = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_-]*):(?:[ \t]+(.*))?$`)
+	// Debian Release: " hash size path"
+	releaseline = regexp.MustCompile(`^[ \t]+([0-9A-Fa-f]+)[ \t]+[0-9]+[ \t]+(.+)$`)
+	// Helm provenance: "  file: sha256:hash"
+	provline = regexp.MustCompile(`^[ \t]+(.+?):[ \t]+([A-Za-z0-9-]+):([0-9A-Fa-f]+)$`)
+)
+
+// releasesections are the Debian Release fields listing files by hash.
+var releasesections = map[string]string{
+	"MD5Sum": "MD5",
+	"SHA1":   "SHA1",
+	"SHA256": "SHA256",
+	"SHA512": "SHA512",
+}
+
+// manifestfields are the fields Debian Release files and Helm provenance
+// files open with.
+var manifestfields = map[string]bool{
+	"Origin":      true,
+	"Label":       true,
+	"Suite":       true,
+	"Codename":    true,
+	"Archive":     true,
+	"annotations": true,
+	"apiVersion":  true,
+}
+
+// parseManifestLine reads a line of a Debian Release or Helm provenance
+// file, where digests are listed under a field of their own and every other
+// field is metadata. section is the field we are in, and is updated.
+func parseManifestLine(line string, n int, section *string) (*Entry, *LineError) {
+	if m := fieldline.FindStringSubmatch(line); m != nil {
+		*section = ""
+		if m[2] == "" {
+			*section = m[1]
+		}
+		return nil, nil
+	}
+	indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+	switch {
+	case !indented && (line == "---" || line == "..." || strings.HasPrefix(line, "- ")):
+		// YAML document markers and list items in provenance metadata
+		return nil, nil
+	case !indented:
+		return nil, &LineError{n, line, "unrecognized line"}
+	case releasesections[*section] != "":
+		m := releaseline.FindStringSubmatch(line)
+		if m == nil {
+			return nil, &LineError{n, line, "unrecognized " + *section + " line"}
+		}
+		alg, digest := releasesections[*section], strings.ToLower(m[1])
+		if digestsizes[alg] != len(digest) {
+			return nil, &LineError{n, line, "digest length does not match " + alg}
+		}
+		return &Entry{alg, m[2], digest, n, 0}, nil
+	case *section == "files":
+		m := provline.FindStringSubmatch(line)
+		if m == nil {
+			return nil, &LineError{n, line, "unrecognized files line"}
+		}
+		alg, digest := canonicalAlgorithm(m[2]), strings.ToLower(m[3])
+		if size, ok := digestsizes[alg]; !ok || size != len(digest) {
+			return nil, &LineError{n, line, "digest length does not match " + alg}
+		}
+		return &Entry{alg, m[1], digest, n, 0}, nil
+	}
+	return nil, nil
+}
+
+// canonicalAlgorithm normalizes the many spellings of an algorithm name
+// ("sha-256", "SHA2-256", "sha256") to the one we use in entries.
+func canonicalAlgorithm(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	name = strings.Replace(name, "SHA2-", "SHA", 1)
+	if strings.HasPrefix(name, "SHA-") {
+		name = "SHA" + name[4:]
+	}
+	switch name {
+	case "SHA512-256", "SHA512_256":
+		name = "SHA512/256"
+	case "BLAKE2B-512":
+		name = "BLAKE2B"
+	}
+	return name
+}
+
+// algorithmHint guesses the algorithm from the name of a checksum file,
+// such as SHA256SUMS or foo.tar.gz.sha512. It returns "" if there is no clue.
+func algorithmHint(name string) string {
+	base := strings.ToUpper(path.Base(name))
+	for _, alg := range []string{"SHA3-224", "SHA3-256", "SHA3-384", "SHA3-512",
+		"SHA224", "SHA256", "SHA384", "SHA512", "SHA1", "MD5"} {
+		if strings.Contains(base, alg) {
+			return alg
+		}
+	}
+	if strings.Contains(base, "B2SUM") || strings.Contains(base, "BLAKE2") {
+		return "BLAKE2B"
+	}
+	return ""
+}
+
+// guessAlgorithm picks an algorithm for a bare hex digest, preferring the
+// hint when the digest is the right size for it.
+func guessAlgorithm(digest, hint string) string {
+	if hint != "" && digestsizes[hint] == len(digest) {
+		return hint
+	}
+	return hexsizes[len(digest)]
+}
+
+// unescapeFilename undoes the escaping GNU coreutils applies to names
+// containing a backslash or newline (the line then starts with a backslash).
+func unescapeFilename(name string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+}
+
+// ParseChecksums reads a checksum file and returns the entries it lists.
+// It understands BSD tag lines ("MD5 (file) = hash"), GNU coreutils lines
+// ("hash  file" and "hash *file"), Fedora CHECKSUM files, files holding
+// a single bare hash, Debian Release files and Helm provenance files.
+// Comment and blank lines are skipped; any other line that does not parse
+// is returned as a LineError. hint is the name the file was published
+// under, used to tell apart algorithms with equal digest sizes. A
+// clearsigned message in r fails the parse with errLateClearsign, as the
+// caller should have found it and parsed only its signed text.
+func ParseChecksums(r io.Reader, hint string) ([]Entry, []*LineError, error) {
+	var (
+		entries []Entry
+		errs    []*LineError
+		bare    []Entry
+		baretxt []string
+		lines   int
+
+		manifest bool
+		section  string
+	)
+	hint = algorithmHint(hint)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 256), maxlinesize)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines++
+
+		if trimmed == clearsignStart {
+			return nil, nil, errLateClearsign
+		}
+
+		// A file that opens with one of their fields is a Release or
+		// provenance file.
+		if m := fieldline.FindStringSubmatch(line); lines == 1 && m != nil && manifestfields[m[1]] {
+			manifest = true
+		}
+		if manifest {
+			e, lerr := parseManifestLine(line, n, &section)
+			if e != nil {
+				entries = append(entries, *e)
+			}
+			if lerr != nil {
+				errs = append(errs, lerr)
+			}
+			continue
+		}
+
+		if m := bsdline.FindStringSubmatch(trimmed); m != nil {
+			alg := canonicalAlgorithm(m[1])
+			digest := strings.ToLower(m[3])
+			if size, ok := digestsizes[alg]; ok && size != len(digest) {
+				errs = append(errs, &LineError{n, line, "digest length does not match " + alg})
+				continue
+			}
+			entries = append(entries, Entry{alg, m[2], digest, n, 0})
+			continue
+		}
+
+		if m := gnuline.FindStringSubmatch(trimmed); m != nil {
+			digest := strings.ToLower(m[1])
+			alg := guessAlgorithm(digest, hint)
+			if alg == "" {
+				errs = append(errs, &LineError{n, line, "unknown digest length"})
+				continue
+			}
+			name := m[2]
+			if strings.HasPrefix(trimmed, `\`) {
+				name = unescapeFilename(name)
+			}
+			entries = append(entries, Entry{alg, name, digest, n, 0})
+			continue
+		}
+
+		if hexline.MatchString(trimmed) {
+			digest := strings.ToLower(trimmed)
+			alg := guessAlgorithm(digest, hint)
+			if alg == "" {
+				errs = append(errs, &LineError{n, line, "unknown digest length"})
+				continue
+			}
+			bare = append(bare, Entry{Algorithm: alg, Digest: digest, Line: n})
+			baretxt = append(baretxt, line)
+			continue
+		}
+
+		errs = append(errs, &LineError{n, line, "unrecognized line"})
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, errs, err
+	}
+
+	// A lone hash is the whole file; anywhere else it is missing its name.
+	if len(bare) == 1 && lines == 1 {
+		return bare, errs, nil
+	}
+	for i, e := range bare {
+		errs = append(errs, &LineError{e.Line, baretxt[i], "missing filename"})
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return entries, errs, nil
+}
+
+// errFileNotListed and errConflictingEntries are why FilterEntries found
+// nothing usable.
+var (
+	errFileNotListed      = errors.New("file not listed")
+	errConflictingEntries = errors.New("conflicting entries")
+)
+
+// FilterEntries returns the entries whose filename, or its base name,
+// matches the glob pattern. A lone bare hash matches any name. It fails if
+// nothing matches, or if a file is listed twice with different digests by
+// the same algorithm.
+func FilterEntries(entries []Entry, pattern string) ([]Entry, error) {
+	var found []Entry
+	seen := map[[2]string]Entry{}
+	for _, e := range entries {
+		if len(entries) != 1 || e.Filename != "" {
+			full, _ := path.Match(pattern, e.Filename)
+			base, _ := path.Match(pattern, path.Base(e.Filename))
+			if !full && !base {
+				continue
+			}
+		}
+		key := [2]string{e.Filename, e.Algorithm}
+		if prev, ok := seen[key]; ok {
+			if !strings.EqualFold(prev.Digest, e.Digest) {
+				return nil, fmt.Errorf("%w: %s %s on lines %d and %d", errConflictingEntries, e.Algorithm, e.Filename, prev.Line, e.Line)
+			}
+			continue
+		}
+		seen[key] = e
+		found = append(found, e)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: no entry matches %q", errFileNotListed, pattern)
+	}
+	return found, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	md5foo    = "acbd18db4cc2f85cedef654fccc4a4d8"
+	sha1foo   = "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	sha256foo = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+)
+
+func TestParseChecksums(t *testing.T) {
+	tests := []struct {
+		name    string
+		hint    string
+		in      string
+		entries []Entry
+		errs    []int // lines of LineErrors
+	}{
+		{
+			name:    "gnu",
+			in:      sha256foo + "  foo.tar.gz\n" + sha1foo + " *bar.zip\n",
+			entries: []Entry{{"SHA256", "foo.tar.gz", sha256foo, 1, 0}, {"SHA1", "bar.zip", sha1foo, 2, 0}},
+		},
+		{
+			name:    "gnu escaped",
+			in:      `\` + md5foo + `  a\\b` + "\n",
+			entries: []Entry{{"MD5", `a\b`, md5foo, 1, 0}},
+		},
+		{
+			name:    "bsd and openssl",
+			in:      "MD5 (foo.tar.gz) = " + md5foo + "\nSHA256(bar.zip)= " + strings.ToUpper(sha256foo) + "\n",
+			entries: []Entry{{"MD5", "foo.tar.gz", md5foo, 1, 0}, {"SHA256", "bar.zip", sha256foo, 2, 0}},
+		},
+		{
+			name:    "fedora",
+			in:      "# Fedora-Workstation-Live-x86_64-40-1.14.iso: 2295853056 bytes\nSHA256 (Fedora.iso) = " + sha256foo + "\n",
+			entries: []Entry{{"SHA256", "Fedora.iso", sha256foo, 2, 0}},
+		},
+		{
+			name:    "bare hash",
+			in:      "\ufeff" + sha256foo + "\r\n",
+			entries: []Entry{{Algorithm: "SHA256", Digest: sha256foo, Line: 1}},
+		},
+		{
+			name:    "bare hash among others",
+			in:      sha256foo + "  foo\n" + sha256foo + "\n",
+			entries: []Entry{{"SHA256", "foo", sha256foo, 1, 0}},
+			errs:    []int{2},
+		},
+		{
+			name:    "hint from name",
+			hint:    "/dl/foo.tar.gz.sha3-256",
+			in:      sha256foo + "  foo.tar.gz\n",
+			entries: []Entry{{"SHA3-256", "foo.tar.gz", sha256foo, 1, 0}},
+		},
+		{
+			name: "bad lines",
+			in:   "# comment\n\nMD5 (foo) = " + sha1foo + "\nabc  foo\nnot a checksum\n",
+			errs: []int{3, 4, 5},
+		},
+		{
+			name: "debian release",
+			in: "Origin: Debian\nMD5Sum:\n " + md5foo + " 1234 main/Contents-all\nSHA256:\n " + sha256foo + " 1234 main/Contents-all\n" +
+				" " + md5foo + " 1 short\n",
+			entries: []Entry{{"MD5", "main/Contents-all", md5foo, 3, 0}, {"SHA256", "main/Contents-all", sha256foo, 5, 0}},
+			errs:    []int{6},
+		},
+		{
+			name:    "debian release, unrecognized line",
+			in:      "Origin: Debian\nSHA256:\n " + sha256foo + " 1234 main/Contents-all\n" + sha256foo + "  evil.iso\n",
+			entries: []Entry{{"SHA256", "main/Contents-all", sha256foo, 3, 0}},
+			errs:    []int{4},
+		},
+		{
+			name:    "field not opening a manifest",
+			in:      "Version: 1.2\n" + sha256foo + "  foo.tar.gz\n",
+			entries: []Entry{{"SHA256", "foo.tar.gz", sha256foo, 2, 0}},
+			errs:    []int{1},
+		},
+		{
+			name:    "section not opening a manifest",
+			in:      "SHA256:\n" + sha256foo + "  foo.tar.gz\nnot a checksum\n",
+			entries: []Entry{{"SHA256", "foo.tar.gz", sha256foo, 2, 0}},
+			errs:    []int{1, 3},
+		},
+		{
+			name:    "helm provenance",
+			in:      "apiVersion: v2\nname: foo\n...\nfiles:\n  foo-1.2.tgz: sha256:" + sha256foo + "\n",
+			entries: []Entry{{"SHA256", "foo-1.2.tgz", sha256foo, 5, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, errs, err := ParseChecksums(strings.NewReader(tt.in), tt.hint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, tt.entries) {
+				t.Errorf("entries\n got %+v\nwant %+v", entries, tt.entries)
+			}
+			var lines []int
+			for _, e := range errs {
+				lines = append(lines, e.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.errs) {
+				t.Errorf("errors on lines %v, want %v: %v", lines, tt.errs, errs)
+			}
+		})
+	}
+}
+
+func TestParseChecksumsClearsigned(t *testing.T) {
+	in := md5foo + "  evil.iso\n" + clearsignStart + "\nHash: SHA256\n\n" + sha256foo + "  foo.iso\n"
+	if _, _, err := ParseChecksums(strings.NewReader(in), ""); err != errLateClearsign {
+		t.Errorf("error %v, want %v", err, errLateClearsign)
+	}
+}
+
+func TestParseChecksumsLongLine(t *testing.T) {
+	_, _, err := ParseChecksums(strings.NewReader(strings.Repeat("a", maxlinesize+1)), "")
+	if err == nil {
+		t.Error("no error for a line over maxlinesize")
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	entries := []Entry{
+		{"SHA256", "foo-1.2.tar.gz", sha256foo, 1, 0},
+		{"SHA256", "dist/foo-1.2.zip", sha256foo, 2, 0},
+		{"MD5", "bar-1.0.tar.gz", md5foo, 3, 0},
+		{"SHA256", "bar-1.0.tar.gz", sha256foo, 4, 0},
+		{"SHA256", "bar-1.0.tar.gz", sha256foo, 5, 0},
+	}
+	conflicting := append(append([]Entry{}, entries...), Entry{"MD5", "bar-1.0.tar.gz", sha1foo[:32], 6, 0})
+	bare := []Entry{{Algorithm: "SHA256", Digest: sha256foo, Line: 1}}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		pattern string
+		lines   []int
+		err     error
+	}{
+		{"exact", entries, "foo-1.2.tar.gz", []int{1}, nil},
+		{"glob", entries, "foo-*", []int{1, 2}, nil},
+		{"base name", entries, "foo-1.2.zip", []int{2}, nil},
+		{"full path", entries, "dist/*.zip", []int{2}, nil},
+		{"duplicates once", entries, "bar-1.0.tar.gz", []int{3, 4}, nil},
+		{"not listed", entries, "baz*", nil, errFileNotListed},
+		{"conflicting", conflicting, "bar-*", nil, errConflictingEntries},
+		{"lone bare hash", bare, "anything.iso", []int{1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := FilterEntries(tt.entries, tt.pattern)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			var lines []int
+			for _, e := range found {
+				lines = append(lines, e.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("lines %v, want %v", lines, tt.lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// clearsignStart marks the beginning of a clearsigned message.
+const clearsignStart = "-----BEGIN PGP SIGNED MESSAGE-----"
+
+// errLateClearsign is why a file with unsigned lines before a clearsigned
+// message further in than we look for one is not parsed: those lines must
+// not pass for its entries.
+var errLateClearsign = errors.New("unsigned content before a clearsigned message")
+
+// isClearsigned reports whether b holds a clearsigned message, as Fedora
+// CHECKSUM files, Helm .prov files and Debian InRelease files do.
+func isClearsigned(b []byte) bool {
+	return bytes.Contains(b, []byte(clearsignStart))
+}
+
+// verifyClearsigned checks the clearsigned message in b against our keyring
+// and returns only the signed text, without its armor. Anything outside the
+// signed section makes the signature invalid, and is never returned.
+func verifyClearsigned(b []byte) ([]byte, *Signature) {
+	s := &Signature{Scheme: "pgp"}
+	block, rest := clearsign.Decode(b)
+	if block == nil {
+		s.Error = "malformed clearsigned message"
+		return nil, s
+	}
+
+	// Clearsigning leaves the unsigned text around it readable, so an attacker
+	// can add lines there without breaking the signature.
+	before := b[:bytes.Index(b, []byte(clearsignStart))]
+	outside := len(bytes.TrimSpace(before)) != 0 || len(bytes.TrimSpace(rest)) != 0
+
+	if len(keyring) == 0 {
+		s.Error = "no keyring configured"
+		return block.Plaintext, s
+	}
+	raw, err := io.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		s.Error = err.Error()
+		return block.Plaintext, s
+	}
+	s = checkPGP(s, block.Bytes, raw)
+	if s.Valid && outside {
+		s.Valid = false
+		s.Error = "unsigned content outside the signed message"
+	}
+	return block.Plaintext, s
+}
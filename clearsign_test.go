@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// clearsigned makes a clearsigned message of text by e.
+func clearsigned(t *testing.T, e *openpgp.Entity, text string) string {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, e.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(text))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestVerifyClearsigned(t *testing.T) {
+	e := pgpEntity(t, "Release Signing", time.Now().Add(-time.Hour), 0)
+	text := sha256foo + "  foo.iso\n"
+	msg := clearsigned(t, e, text)
+	tampered := strings.Replace(msg, "foo.iso", "evil.iso", 1)
+
+	tests := []struct {
+		name    string
+		keyring openpgp.EntityList
+		in      string
+		text    string
+		err     string
+	}{
+		{"valid", openpgp.EntityList{e}, msg, text, ""},
+		{"no keyring", nil, msg, text, "no keyring configured"},
+		{"changed text", openpgp.EntityList{e}, tampered, strings.Replace(text, "foo", "evil", 1), "invalid signature"},
+		{"content before", openpgp.EntityList{e}, md5foo + "  evil.iso\n" + msg, text, "unsigned content outside the signed message"},
+		{"content after", openpgp.EntityList{e}, msg + md5foo + "  evil.iso\n", text, "unsigned content outside the signed message"},
+		{"malformed", openpgp.EntityList{e}, clearsignStart + "\n\n" + text, "", "malformed clearsigned message"},
+	}
+	saved := keyring
+	defer func() { keyring = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring = tt.keyring
+			plain, s := verifyClearsigned([]byte(tt.in))
+			if s.Valid != (tt.err == "") || !strings.Contains(s.Error, tt.err) {
+				t.Errorf("valid %v, error %q, want error %q", s.Valid, s.Error, tt.err)
+			}
+			// Whatever else, only the signed text is parsed
+			if string(plain) != tt.text {
+				t.Errorf("text %q, want %q", plain, tt.text)
+			}
+		})
+	}
+}
+
+// TestFetchClearsigned fetches clearsigned checksum files with unsigned lines
+// around the signed message, more of them than fit in the head we sniff.
+func TestFetchClearsigned(t *testing.T) {
+	e := pgpEntity(t, "Release Signing", time.Now().Add(-time.Hour), 0)
+	msg := clearsigned(t, e, sha256foo+"  foo.iso\n")
+	padding := md5foo + "  evil.iso\n" + strings.Repeat("#\n", 300)
+
+	tests := []struct {
+		name  string
+		body  string
+		files []string // the entries returned
+		err   string   // the APIError code
+		sig   string   // the embedded signature's error
+	}{
+		{"signed", msg, []string{"foo.iso"}, "", ""},
+		{"short prefix", md5foo + "  evil.iso\n" + msg, []string{"foo.iso"}, "", "unsigned content outside the signed message"},
+		{"long prefix", padding + msg, nil, CodeBadChecksumFile, ""},
+		{"suffix", msg + padding, []string{"foo.iso"}, "", "unsigned content outside the signed message"},
+	}
+	saved := keyring
+	keyring = openpgp.EntityList{e}
+	defer func() { keyring = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			u, _ := url.Parse(srv.URL + "/CHECKSUM")
+			req := &HashRequest{URL: u, Limits: Limits{Body: 1 << 20}, Redirects: RedirectPolicy{MaxHops: 1}}
+
+			cf, err := (&HashRequester{}).fetchChecksums(context.Background(), req)
+			if tt.err != "" {
+				var apierr *APIError
+				if !errors.As(err, &apierr) || apierr.Code != tt.err {
+					t.Fatalf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, e := range cf.Entries {
+				files = append(files, e.Filename)
+			}
+			if strings.Join(files, ",") != strings.Join(tt.files, ",") {
+				t.Errorf("entries for %v, want %v", files, tt.files)
+			}
+			if cf.Signature == nil {
+				t.Fatal("no signature")
+			}
+			if cf.Signature.Valid != (tt.sig == "") || cf.Signature.Error != tt.sig {
+				t.Errorf("signature valid %v, error %q, want error %q", cf.Signature.Valid, cf.Signature.Error, tt.sig)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flightGroup coalesces concurrent fetches of the same checksum file into
+// one, so a popular release does not have us fetch it once per client.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// flight is one fetch, and who is waiting on it.
+type flight struct {
+	done    chan struct{}
+	cf      *checksumFile
+	err     error
+	waiting int // callers still waiting
+	callers int // callers ever
+	cancel  context.CancelFunc
+}
+
+// flightKey is what requests must agree on to share a fetch: the file, and
+// everything that changes how it is fetched and parsed. Not deadlines: the
+// fetch runs under the server's, and each caller waits only as long as its
+// own.
+func flightKey(req *HashRequest) string {
+	return fmt.Sprintf("%s %d %+v %t %t %t", cacheKey(req.URL), req.Limits.Body,
+		req.Redirects, req.NoCache, req.Sig != nil, req.HTML)
+}
+
+// Do runs fn for key, or if it is already running, waits for it instead.
+// fn runs apart from any one caller, and is cancelled only once every
+// caller has given up; each caller stops waiting when its own ctx is done.
+// shared reports whether other callers got the same result.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(context.Context) (*checksumFile, error)) (cf *checksumFile, shared bool, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = map[string]*flight{}
+	}
+	f, ok := g.m[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.m[key] = f
+		go func() {
+			f.cf, f.err = fn(fctx)
+			g.mu.Lock()
+			if g.m[key] == f {
+				delete(g.m, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiting++
+	f.callers++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		g.mu.Lock()
+		shared = f.callers > 1
+		g.mu.Unlock()
+		return f.cf, shared, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		if f.waiting--; f.waiting == 0 {
+			// Nobody wants it any more; later callers start afresh
+			f.cancel()
+			if g.m[key] == f {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, false, fetchErr(ctx, ctx.Err())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitCallers waits until n callers are waiting on key.
+func waitCallers(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		f := g.m[key]
+		ok := f != nil && f.waiting == n
+		g.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("%d callers never waited on %q", n, key)
+}
+
+func TestFlightGroup(t *testing.T) {
+	tests := []struct {
+		name      string
+		callers   int
+		giveUp    int // callers whose ctx is done before the fetch is
+		cancelled bool
+	}{
+		{"one caller", 1, 0, false},
+		{"shared", 3, 0, false},
+		{"one gives up", 3, 1, false},
+		{"all but one give up", 3, 2, false},
+		{"all give up", 2, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g flightGroup
+			var runs atomic.Int32
+			want := &checksumFile{FinalURL: "https://example.org/SHA256SUMS"}
+			release := make(chan struct{})
+			cancelled := make(chan struct{})
+			fn := func(ctx context.Context) (*checksumFile, error) {
+				runs.Add(1)
+				select {
+				case <-release:
+					return want, nil
+				case <-ctx.Done():
+					close(cancelled)
+					return nil, ctx.Err()
+				}
+			}
+
+			type result struct {
+				cf     *checksumFile
+				shared bool
+				err    error
+			}
+			results := make([]chan result, tt.callers)
+			cancels := make([]context.CancelFunc, tt.callers)
+			for i := range results {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				results[i] = make(chan result, 1)
+				go func(c chan result) {
+					cf, shared, err := g.Do(ctx, "key", fn)
+					c <- result{cf, shared, err}
+				}(results[i])
+				waitCallers(t, &g, "key", i+1)
+			}
+			defer func() {
+				for _, cancel := range cancels {
+					cancel()
+				}
+			}()
+
+			for i := 0; i < tt.giveUp; i++ {
+				cancels[i]()
+				if r := <-results[i]; r.cf != nil || r.err != errClientGone {
+					t.Errorf("caller %d gave up and got %v, %v", i, r.cf, r.err)
+				}
+			}
+			select {
+			case <-cancelled:
+				if !tt.cancelled {
+					t.Error("fetch cancelled while callers still wait")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if tt.cancelled {
+					t.Error("fetch not cancelled once every caller gave up")
+				}
+			}
+			close(release)
+			for i := tt.giveUp; i < tt.callers; i++ {
+				r := <-results[i]
+				if r.cf != want || r.err != nil || r.shared != (tt.callers > 1) {
+					t.Errorf("caller %d got %v, shared %v, %v", i, r.cf, r.shared, r.err)
+				}
+			}
+			if runs.Load() != 1 {
+				t.Errorf("fetched %d times", runs.Load())
+			}
+		})
+	}
+}
+
+func TestFlightGroupKeys(t *testing.T) {
+	var g flightGroup
+	var runs atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*checksumFile, error) {
+		runs.Add(1)
+		<-release
+		return &checksumFile{}, nil
+	}
+	done := make(chan bool)
+	for _, key := range []string{"a", "b"} {
+		go func(key string) {
+			_, shared, _ := g.Do(context.Background(), key, fn)
+			done <- shared
+		}(key)
+		waitCallers(t, &g, key, 1)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if <-done {
+			t.Error("different keys shared a fetch")
+		}
+	}
+	if runs.Load() != 2 {
+		t.Errorf("fetched %d times, want 2", runs.Load())
+	}
+
+	// Once done, the same key fetches again
+	if _, shared, _ := g.Do(context.Background(), "a", fn); shared || runs.Load() != 3 {
+		t.Errorf("shared %v after %d fetches", shared, runs.Load())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultContentTypes are what checksum files are served as in practice:
+// text, whatever mirrors and object stores call unknown files, and
+// clearsigned or armored files.
+const defaultContentTypes = "text/plain,application/octet-stream,binary/octet-stream,application/pgp-signature,application/pgp-keys"
+
+// errNotChecksumFile is why we refuse a body that is something else.
+var errNotChecksumFile = errors.New("not a checksum file")
+
+// mediaRange is an allowed media type ("text/plain", "text/*") and the
+// parameters a response must have with it, if any.
+type mediaRange struct {
+	typ    string
+	params map[string]string
+}
+
+// contentTypes are the media types we take a checksum file as, from
+// -content-types.
+var contentTypes = mustContentTypes(defaultContentTypes)
+
+func mustContentTypes(list string) []mediaRange {
+	ranges, err := parseContentTypes(list)
+	if err != nil {
+		panic(err)
+	}
+	return ranges
+}
+
+// parseContentTypes reads a comma separated list of media types, each with
+// optional parameters: "text/plain;charset=utf-8,application/octet-stream".
+func parseContentTypes(list string) ([]mediaRange, error) {
+	var ranges []mediaRange
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		typ, params, err := mime.ParseMediaType(s)
+		if err != nil {
+			return nil, fmt.Errorf("content type %q: %v", s, err)
+		}
+		if !strings.Contains(typ, "/") {
+			return nil, fmt.Errorf("content type %q: no subtype", s)
+		}
+		ranges = append(ranges, mediaRange{typ, params})
+	}
+	return ranges, nil
+}
+
+func (m mediaRange) matches(typ string, params map[string]string) bool {
+	if m.typ != typ && !(strings.HasSuffix(m.typ, "/*") && strings.HasPrefix(typ, m.typ[:len(m.typ)-1])) {
+		return false
+	}
+	for k, v := range m.params {
+		if !strings.EqualFold(params[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedContentType checks the Content-Type upstream sent against
+// contentTypes. A missing one is taken as application/octet-stream, which
+// is what it means.
+func allowedContentType(ct string) error {
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	typ, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("upstream sent %q: %v", ct, err)
+	}
+	for _, m := range contentTypes {
+		if m.matches(typ, params) {
+			return nil
+		}
+	}
+	return fmt.Errorf("upstream sent %q, we take %s", ct, *contenttypes)
+}
+
+// captiveMarkers give away the login pages hotel and airport networks serve
+// in place of whatever was asked for.
+var captiveMarkers = []string{
+	"captive", "hotspot", "wifi login", "wi-fi login", "accept the terms",
+	"http-equiv=\"refresh\"", "http-equiv=refresh", "window.location",
+}
+
+// isHTMLType reports whether the Content-Type ct is an HTML page.
+func isHTMLType(ct string) bool {
+	typ, _, _ := mime.ParseMediaType(ct)
+	return typ == "text/html" || typ == "application/xhtml+xml"
+}
+
+// looksLikeHTML reports whether the start of a body is an HTML page.
+func looksLikeHTML(b []byte) bool {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if strings.HasPrefix(http.DetectContentType(b), "text/html") {
+		return true
+	}
+	lower := bytes.ToLower(bytes.TrimSpace(b))
+	for _, tag := range []string{"<!doctype", "<html", "<head", "<body", "<?xml", "<title", "<script"} {
+		if bytes.HasPrefix(lower, []byte(tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikePortal reports whether the start of an HTML page is a captive
+// portal's.
+func looksLikePortal(b []byte) bool {
+	lower := bytes.ToLower(b)
+	for _, m := range captiveMarkers {
+		if bytes.Contains(lower, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniff looks at the start of a body and refuses it if it is an HTML page
+// (an error page, or a captive portal's) or binary data rather than text.
+func sniff(b []byte) error {
+	cut := len(b) >= 512
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if len(b) > 512 {
+		b = b[:512]
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+
+	if looksLikeHTML(b) {
+		if looksLikePortal(b) {
+			return fmt.Errorf("%w: looks like a captive portal page", errNotChecksumFile)
+		}
+		return fmt.Errorf("%w: looks like an HTML page, probably an error page", errNotChecksumFile)
+	}
+
+	// Cutting at 512 bytes may split a rune; only the last one may be
+	// incomplete, and only if we cut.
+	valid := b
+	for i := 1; cut && i < utf8.UTFMax && i <= len(valid); i++ {
+		if tail := valid[len(valid)-i:]; utf8.RuneStart(tail[0]) {
+			if !utf8.FullRune(tail) {
+				valid = valid[:len(valid)-i]
+			}
+			break
+		}
+	}
+	if bytes.IndexByte(b, 0) >= 0 || !utf8.Valid(valid) {
+		return fmt.Errorf("%w: binary data (%s)", errNotChecksumFile, http.DetectContentType(b))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAllowedContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		ct      string
+		ok      bool
+	}{
+		{"text", defaultContentTypes, "text/plain; charset=utf-8", true},
+		{"octet stream", defaultContentTypes, "application/octet-stream", true},
+		{"none", defaultContentTypes, "", true},
+		{"armored", defaultContentTypes, "application/pgp-signature", true},
+		{"html", defaultContentTypes, "text/html", false},
+		{"json", defaultContentTypes, "application/json", false},
+		{"malformed", defaultContentTypes, "text/plain; charset", false},
+		{"wildcard", "text/*", "text/x-sha256", true},
+		{"wildcard, other type", "text/*", "textual/plain", false},
+		{"parameter", "text/plain;charset=utf-8", "text/plain; charset=UTF-8", true},
+		{"parameter missing", "text/plain;charset=utf-8", "text/plain", false},
+		{"parameter differs", "text/plain;charset=utf-8", "text/plain; charset=latin1", false},
+	}
+	saved := contentTypes
+	defer func() { contentTypes = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentTypes = mustContentTypes(tt.allowed)
+			if err := allowedContentType(tt.ct); (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseContentTypes(t *testing.T) {
+	for _, list := range []string{"text", "text/plain; charset", "/plain"} {
+		if _, err := parseContentTypes(list); err == nil {
+			t.Errorf("no error for %q", list)
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"checksums", sha256foo + "  foo\n", ""},
+		{"empty", "", ""},
+		{"bom", "\ufeff" + sha256foo + "  foo\n", ""},
+		{"utf-8 name", sha256foo + "  fö.tar.gz\n", ""},
+		{"rune cut at 512", strings.Repeat("a", 511) + "ö", ""},
+		{"rune cut at 512, after a bom", "\ufeff" + strings.Repeat("a", 508) + "ö", ""},
+		{"error page", "<!DOCTYPE html><html><body>Not Found</body></html>", "HTML page"},
+		{"error page, indented", "\n  <html><head><title>404</title></head></html>", "HTML page"},
+		{"captive portal", "<html><body>Accept the terms to use the WiFi</body></html>", "captive portal"},
+		{"gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", "binary data"},
+		{"nul", sha256foo + "\x00", "binary data"},
+		{"latin-1", sha256foo + "  f\xf6\n", "binary data"},
+		{"latin-1 at 512", strings.Repeat("a", 510) + "\xf6\n", "binary data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sniff([]byte(tt.in))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("error %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errNotChecksumFile) || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// Where projects put checksums and signatures next to an artifact, in the
+// order we prefer them. Suffixes go on the artifact's name, the rest are
+// files in the same directory.
+var (
+	checksumSuffixes = []string{".sha512", ".sha256", ".sha256sum", ".sha1", ".md5"}
+	checksumNames    = []string{"SHA512SUMS", "SHA256SUMS", "CHECKSUMS", "sha256sum.txt", "sha256sums.txt", "checksums.txt"}
+	signatureSuffix  = []string{".asc", ".sig", ".minisig"}
+
+	// We check only minisign signatures over artifacts
+	artifactSigSuffix = []string{".minisig"}
+)
+
+// checksumName matches other names of checksum files, as found in
+// directory listings.
+var checksumName = regexp.MustCompile(`(?i)(sha(1|224|256|384|512)|md5|b2|blake2b?|checksums?)(sums?)?(\.txt)?$`)
+
+// Found is a file discovered next to an artifact.
+type Found struct {
+	URL  string `json:"url"`
+	Kind string `json:"kind"` // "checksums", "signature" or "artifact_signature"
+	Used bool   `json:"used"`
+}
+
+// Discovery is what we found next to an artifact, and how.
+type Discovery struct {
+	Listing string  `json:"listing,omitempty"` // directory listing we read
+	Found   []Found `json:"found"`
+
+	exists func(names []string) []bool // which of names are there
+}
+
+// sibling returns the file called name in the directory of u.
+func sibling(u *url.URL, name string) *url.URL {
+	s := *u
+	s.Path = path.Join(path.Dir(u.Path), name)
+	s.RawPath = ""
+	s.RawQuery = ""
+	s.Fragment = ""
+	return &s
+}
+
+// probe reports which of urls exist, asking no more of a host at once
+// than -batch-per-host: a slot each, or within a batch item that holds one
+// on the host already, one at a time in that.
+func probe(ctx context.Context, req *HashRequest, urls []*url.URL) []bool {
+	exists := make([]bool, len(urls))
+	held := heldHosts(ctx)
+	var (
+		wg  sync.WaitGroup
+		one sync.Mutex
+	)
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			if contains(held, u.Hostname()) {
+				one.Lock()
+				defer one.Unlock()
+			} else {
+				release, err := batchHosts.acquire(ctx, []string{u.Hostname()})
+				if err != nil {
+					return
+				}
+				defer release()
+			}
+			exists[i] = probeOne(ctx, req, u)
+		}(i, u)
+	}
+	wg.Wait()
+	return exists
+}
+
+// probeOne reports whether u exists, by its headers, or by getting it from
+// servers that take no HEAD.
+func probeOne(ctx context.Context, req *HashRequest, u *url.URL) bool {
+	pctx, _ := trackRedirects(ctx, req.Redirects)
+	resp, err := head(pctx, u, req.Deadlines)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		pctx, _ = trackRedirects(ctx, req.Redirects)
+		if resp, err = get(pctx, u, req.Deadlines); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return err == nil && resp.StatusCode == http.StatusOK
+}
+
+// readListing reads the links in the directory listing (Apache, nginx and
+// the like) at dir to the files in it. It returns nil if there is no
+// listing.
+func readListing(ctx context.Context, req *HashRequest, dir *url.URL) map[string]bool {
+	lctx, _ := trackRedirects(ctx, req.Redirects)
+	resp, err := get(lctx, dir, req.Deadlines)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if typ, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); resp.StatusCode != http.StatusOK || typ != "text/html" {
+		return nil
+	}
+
+	names := map[string]bool{}
+	z := html.NewTokenizer(io.LimitReader(resp.Body, req.Limits.Body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return names
+		case html.StartTagToken:
+			tn, hasAttr := z.TagName()
+			if string(tn) != "a" {
+				continue
+			}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) != "href" {
+					continue
+				}
+				link, err := resp.Request.URL.Parse(string(v))
+				if err != nil || link.Host != resp.Request.URL.Host || strings.HasSuffix(link.Path, "/") {
+					continue
+				}
+				if path.Dir(link.Path) == path.Clean(resp.Request.URL.Path) {
+					names[path.Base(link.Path)] = true
+				}
+			}
+		}
+	}
+}
+
+// discover looks next to req.Artifact for checksum files, which it lists
+// in the order we prefer them for the caller to find one listing the
+// artifact, and a minisign signature over the artifact, which it fills in
+// as req.ArtifactSig. It reads the directory listing if there is one, and
+// otherwise probes the usual names.
+func discover(ctx context.Context, req *HashRequest) *Discovery {
+	d := &Discovery{Found: []Found{}}
+	name := path.Base(req.Artifact.Path)
+	dir := sibling(req.Artifact, "")
+	dir.Path = strings.TrimSuffix(dir.Path, "/") + "/"
+
+	var sums, artifactsigs []string
+	for _, s := range checksumSuffixes {
+		sums = append(sums, name+s)
+	}
+	sums = append(sums, checksumNames...)
+	for _, s := range artifactSigSuffix {
+		artifactsigs = append(artifactsigs, name+s)
+	}
+
+	// A listing tells us what is there without guessing
+	listed := readListing(ctx, req, dir)
+	if len(listed) > 0 {
+		log.Println("Read listing", dir)
+		d.Listing = dir.String()
+		var extra []string
+		for n := range listed {
+			// Skip the checksums of other artifacts
+			if stem := strings.TrimSuffix(n, path.Ext(n)); listed[stem] && stem != name {
+				continue
+			}
+			if !contains(sums, n) && n != name && checksumName.MatchString(n) {
+				extra = append(extra, n)
+			}
+		}
+		sort.Strings(extra)
+		sums = append(sums, extra...)
+		d.exists = func(names []string) []bool {
+			found := make([]bool, len(names))
+			for i, n := range names {
+				found[i] = listed[n]
+			}
+			return found
+		}
+	} else {
+		d.exists = func(names []string) []bool {
+			urls := make([]*url.URL, len(names))
+			for i, n := range names {
+				urls[i] = sibling(req.Artifact, n)
+			}
+			return probe(ctx, req, urls)
+		}
+	}
+
+	found := d.exists(append(append([]string{}, sums...), artifactsigs...))
+	for i, n := range sums {
+		if found[i] {
+			d.Found = append(d.Found, Found{URL: sibling(req.Artifact, n).String(), Kind: "checksums"})
+		}
+	}
+	for i, n := range artifactsigs {
+		if !found[len(sums)+i] {
+			continue
+		}
+		u := sibling(req.Artifact, n)
+		f := Found{URL: u.String(), Kind: "artifact_signature"}
+		if req.ArtifactSig == nil {
+			req.ArtifactSig, f.Used = u, true
+		}
+		d.Found = append(d.Found, f)
+	}
+	return d
+}
+
+// use marks the checksum file u as the one used, and looks for a
+// signature over it, which it fills in as req.Sig.
+func (d *Discovery) use(req *HashRequest, u string) {
+	for i := range d.Found {
+		if d.Found[i].Kind == "checksums" && d.Found[i].URL == u {
+			d.Found[i].Used = true
+		}
+	}
+	if req.Sig != nil {
+		return
+	}
+	var sigs []string
+	for _, s := range signatureSuffix {
+		sigs = append(sigs, path.Base(req.URL.Path)+s)
+	}
+	for i, ok := range d.exists(sigs) {
+		if !ok {
+			continue
+		}
+		u := sibling(req.URL, sigs[i])
+		f := Found{URL: u.String(), Kind: "signature"}
+		if req.Sig == nil {
+			req.Sig, f.Used = u, true
+		}
+		d.Found = append(d.Found, f)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
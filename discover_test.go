@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	const foo = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c" // "foo\n"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		listing bool
+		used    string // checksum file used, "" for none
+		sig     string // signature used over it
+		found   int
+		match   bool // false where a junk .minisig is found and used
+	}{
+		{
+			name:  "first listing it",
+			files: map[string]string{"SHA512SUMS": "", "SHA256SUMS": foo + "  foo.tar.gz\n", "foo.tar.gz.asc": "x"},
+			used:  "SHA256SUMS",
+			found: 2,
+			match: true,
+		},
+		{
+			name:    "first listing it, from a listing",
+			files:   map[string]string{"SHA512SUMS": "", "SHA256SUMS": foo + "  foo.tar.gz\n", "foo.tar.gz.asc": "x"},
+			listing: true,
+			used:    "SHA256SUMS",
+			found:   2,
+			match:   true,
+		},
+		{
+			name:  "preferred",
+			files: map[string]string{"foo.tar.gz.sha256": foo + "\n", "SHA256SUMS": foo + "  foo.tar.gz\n", "SHA256SUMS.asc": "x"},
+			used:  "foo.tar.gz.sha256",
+			found: 2,
+			match: true,
+		},
+		{
+			name:  "with a signature",
+			files: map[string]string{"SHA256SUMS": foo + "  foo.tar.gz\n", "SHA256SUMS.asc": "x", "foo.tar.gz.minisig": "x"},
+			used:  "SHA256SUMS",
+			sig:   "SHA256SUMS.asc",
+			found: 3,
+		},
+		{
+			name:  "none listing it",
+			files: map[string]string{"SHA256SUMS": foo + "  bar.tar.gz\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.files["foo.tar.gz"] = "foo\n"
+			if !tt.listing {
+				tt.files["index.html"] = "<html></html>"
+			}
+			for name, body := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+			defer srv.Close()
+			artifact, _ := url.Parse(srv.URL + "/foo.tar.gz")
+			req := &HashRequest{Artifact: artifact, Limits: Limits{Body: 1 << 20, Sig: 1 << 10}, Redirects: RedirectPolicy{MaxHops: 1}}
+
+			resp, err := (&HashRequester{}).Do(context.Background(), req)
+			if tt.used == "" {
+				var apierr *APIError
+				if !errors.As(err, &apierr) || apierr.Code != CodeNothingDiscovered {
+					t.Fatalf("error %v, want %s", err, CodeNothingDiscovered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.URL != srv.URL+"/"+tt.used {
+				t.Errorf("used %s, want %s", resp.URL, tt.used)
+			}
+			if resp.Verification.Match != tt.match {
+				t.Errorf("match %v: %+v", resp.Verification.Match, resp.Verification)
+			}
+			if tt.sig != "" && (resp.Signature == nil || resp.Signature.URL != srv.URL+"/"+tt.sig) {
+				t.Errorf("signature %+v, want %s", resp.Signature, tt.sig)
+			}
+			if len(resp.Discovery.Found) != tt.found {
+				t.Errorf("found %+v", resp.Discovery.Found)
+			}
+			for _, f := range resp.Discovery.Found {
+				if f.URL == srv.URL+"/foo.tar.gz.asc" {
+					t.Error("found a signature over the artifact we do not check")
+				}
+			}
+		})
+	}
+}
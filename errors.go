@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// APIError is a failure we report to the client, with a stable
+// machine-readable code.
+type APIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Error codes. Clients may rely on these not changing.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeBadURL             = "bad_url"
+	CodeURLTooLong         = "url_too_long"
+	CodeForbiddenAddress   = "forbidden_address"
+	CodeUnsupportedContent = "unsupported_content_type"
+	CodeUpstreamError      = "upstream_error"
+	CodeUpstreamStatus     = "upstream_status"
+	CodeUpstreamTimeout    = "upstream_timeout"
+	CodeRedirectRefused    = "redirect_refused"
+	CodeBadChecksumFile    = "bad_checksum_file"
+	CodeNotChecksumFile    = "not_a_checksum_file"
+	CodeFileNotListed      = "file_not_listed"
+	CodeNothingDiscovered  = "nothing_discovered"
+	CodeConflictingEntries = "conflicting_entries"
+	CodeNoLog              = "no_log"
+	CodeNotInLog           = "not_in_log"
+	CodeNoJobs             = "no_jobs"
+	CodeNoSuchJob          = "no_such_job"
+	CodeQueueFull          = "queue_full"
+	CodeInternal           = "internal_error"
+)
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{status, code, message}
+}
+
+// upstreamError classifies a failed fetch as refused by us, a redirect we
+// would not follow, a timeout or any other upstream failure.
+func upstreamError(err error) *APIError {
+	var ne net.Error
+	switch {
+	case errors.Is(err, errForbiddenAddress):
+		return newAPIError(http.StatusForbidden, CodeForbiddenAddress, err.Error())
+	case errors.Is(err, errRedirectRefused):
+		return newAPIError(http.StatusBadGateway, CodeRedirectRefused, err.Error())
+	case errors.Is(err, errDialTimeout), errors.Is(err, errTLSTimeout),
+		errors.Is(err, errHeaderTimeout), errors.Is(err, errTotalTimeout):
+		return newAPIError(http.StatusGatewayTimeout, CodeUpstreamTimeout, err.Error())
+	case errors.As(err, &ne) && ne.Timeout():
+		return newAPIError(http.StatusGatewayTimeout, CodeUpstreamTimeout, err.Error())
+	}
+	return newAPIError(http.StatusBadGateway, CodeUpstreamError, err.Error())
+}
+
+// templates are the html templates in ./templates, used to show errors to
+// browsers.
+var templates *template.Template
+
+// loadTemplates parses ./templates, logging rather than failing if they are
+// missing, as API clients never see them.
+func loadTemplates() {
+	t, err := template.ParseGlob("templates/*.html")
+	if err != nil {
+		log.Println("templates:", err)
+		return
+	}
+	templates = t
+}
+
+// writeError sends err to the client: through the "Error" template for
+// browsers, as JSON for everyone else.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *APIError
+	if !errors.As(err, &e) {
+		e = newAPIError(http.StatusInternalServerError, CodeInternal, err.Error())
+	}
+	log.Printf("%d %s", e.Status, e)
+
+	if templates != nil && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(e.Status)
+		if err := templates.ExecuteTemplate(w, "Error", map[string]interface{}{
+			"err":    e.Message,
+			"code":   e.Code,
+			"status": e.Status,
+		}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(map[string]*APIError{"error": e}); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors a fetch is cancelled with, so callers can tell why it stopped.
+var (
+	errDialTimeout   = errors.New("timeout connecting to upstream")
+	errTLSTimeout    = errors.New("timeout in TLS handshake with upstream")
+	errHeaderTimeout = errors.New("timeout waiting for upstream response headers")
+	errTotalTimeout  = errors.New("timeout fetching from upstream")
+	errClientGone    = errors.New("client went away")
+)
+
+// Deadlines bound each phase of a fetch. A zero duration is no bound.
+type Deadlines struct {
+	Dial   time.Duration
+	TLS    time.Duration
+	Header time.Duration
+	Total  time.Duration
+}
+
+// Min returns the tighter of each of d's and o's deadlines.
+func (d Deadlines) Min(o Deadlines) Deadlines {
+	min := func(a, b time.Duration) time.Duration {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	return Deadlines{min(d.Dial, o.Dial), min(d.TLS, o.TLS), min(d.Header, o.Header), min(d.Total, o.Total)}
+}
+
+// parseTimeout reads a duration given as "1.5s" or as plain seconds.
+func parseTimeout(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("bad timeout %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// requestDeadlines reads the deadlines a client asked for, prefixed by
+// prefix ("" or "artifact_"), and tightens server with them. Clients can
+// only shorten the server's deadlines.
+func requestDeadlines(r *http.Request, prefix string, server Deadlines) (Deadlines, error) {
+	var d Deadlines
+	for _, f := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"timeout", &d.Total},
+		{"dial_timeout", &d.Dial},
+		{"tls_timeout", &d.TLS},
+		{"header_timeout", &d.Header},
+	} {
+		v := r.FormValue(prefix + f.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeout(v)
+		if err != nil {
+			return d, err
+		}
+		*f.dst = t
+	}
+	return server.Min(d), nil
+}
+
+// phaseTimer cancels a fetch when one of its phases runs too long.
+type phaseTimer struct {
+	mu     sync.Mutex
+	timers map[error]*time.Timer
+	cancel context.CancelCauseFunc
+}
+
+func (p *phaseTimer) start(d time.Duration, cause error) {
+	if d <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timers[cause] == nil {
+		p.timers[cause] = time.AfterFunc(d, func() { p.cancel(cause) })
+	}
+}
+
+func (p *phaseTimer) stop(cause error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t := p.timers[cause]; t != nil {
+		t.Stop()
+		delete(p.timers, cause)
+	}
+}
+
+// withDeadlines returns a context for a single fetch. It is cancelled when
+// parent is (the client disconnected), when the fetch as a whole outlasts
+// d.Total, or when connecting, the TLS handshake or waiting for response
+// headers outlast theirs, on the first request or any redirect.
+func withDeadlines(parent context.Context, d Deadlines) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	p := &phaseTimer{timers: map[error]*time.Timer{}, cancel: cancel}
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { p.start(d.Dial, errDialTimeout) },
+		ConnectDone:          func(string, string, error) { p.stop(errDialTimeout) },
+		TLSHandshakeStart:    func() { p.start(d.TLS, errTLSTimeout) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.stop(errTLSTimeout) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.start(d.Header, errHeaderTimeout) },
+		GotFirstResponseByte: func() { p.stop(errHeaderTimeout) },
+	}
+	ctx = httptrace.WithClientTrace(ctx, trace)
+
+	stopTotal := func() bool { return true }
+	if d.Total > 0 {
+		t := time.AfterFunc(d.Total, func() { cancel(errTotalTimeout) })
+		stopTotal = t.Stop
+	}
+	return ctx, func() {
+		stopTotal()
+		p.mu.Lock()
+		for _, t := range p.timers {
+			t.Stop()
+		}
+		p.mu.Unlock()
+		cancel(context.Canceled)
+	}
+}
+
+// fetchErr explains why a fetch under ctx failed with err.
+func fetchErr(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	cause := context.Cause(ctx)
+	if cause == context.Canceled {
+		return errClientGone
+	}
+	return cause
+}
+
+// newGet creates the http request we send to alien servers.
+func newGet(ctx context.Context, u *url.URL) *http.Request {
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Header: http.Header{
+			"User-Agent": {"checksigd/0.1"},
+		},
+	}
+	return req.WithContext(ctx)
+}
+
+// fetchBody wraps a response body so reading it tells why the fetch was
+// cancelled, and closing it releases the fetch's timers.
+type fetchBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != io.EOF {
+		err = fetchErr(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *fetchBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// get sends a GET for u through apigun, bounded by d and by ctx.
+func get(ctx context.Context, u *url.URL, d Deadlines) (*http.Response, error) {
+	return getIf(ctx, u, d, nil)
+}
+
+// getIf is get with the extra request headers h, such as conditions.
+func getIf(ctx context.Context, u *url.URL, d Deadlines, h http.Header) (*http.Response, error) {
+	ctx, cancel := withDeadlines(ctx, d)
+	req := newGet(ctx, u)
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	resp, err := apigun.Do(req)
+	if err != nil {
+		err = fetchErr(ctx, err)
+		cancel()
+		return nil, err
+	}
+	resp.Body = &fetchBody{resp.Body, ctx, cancel}
+	return resp, nil
+}
+
+// head asks for the headers of u, as get does for all of it.
+func head(ctx context.Context, u *url.URL, d Deadlines) (*http.Response, error) {
+	ctx, cancel := withDeadlines(ctx, d)
+	defer cancel()
+	req := newGet(ctx, u)
+	req.Method = "HEAD"
+	resp, err := apigun.Do(req)
+	if err != nil {
+		return nil, fetchErr(ctx, err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// fetch gets u through the cache and returns its body, which may be no
+// more than limit bytes, recording it in the history.
+func fetch(ctx context.Context, u *url.URL, limit int64, d Deadlines, revalidate bool) ([]byte, error) {
+	ctx, addr := withRemoteAddr(ctx)
+	resp, info, err := cache.Get(ctx, u, d, limit, revalidate)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%s: over %d bytes", u, limit)
+	}
+	if info == nil || !info.Hit {
+		sum := sha256.Sum256(b)
+		history.Observe(observation(cacheKey(u), resp, hex.EncodeToString(sum[:]), int64(len(b)), false, addr.String()))
+	}
+	return b, nil
+}
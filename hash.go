@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// hashbufsize is how much of a stream we hold in memory while hashing it.
+const hashbufsize = 32 * 1024
+
+// algorithms are the digests the hashing engine can compute, strongest first.
+var algorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"SHA3-512", func() hash.Hash { return sha3.New512() }},
+	{"BLAKE2B", func() hash.Hash { return mustBlake2b(blake2b.New512(nil)) }},
+	{"SHA512", sha512.New},
+	{"SHA3-384", func() hash.Hash { return sha3.New384() }},
+	{"BLAKE2B-384", func() hash.Hash { return mustBlake2b(blake2b.New384(nil)) }},
+	{"SHA384", sha512.New384},
+	{"SHA3-256", func() hash.Hash { return sha3.New256() }},
+	{"BLAKE2B-256", func() hash.Hash { return mustBlake2b(blake2b.New256(nil)) }},
+	{"SHA512/256", sha512.New512_256},
+	{"SHA256", sha256.New},
+	{"SHA3-224", func() hash.Hash { return sha3.New224() }},
+	{"SHA224", sha256.New224},
+	{"SHA1", sha1.New},
+	{"MD5", md5.New},
+}
+
+// digestsizes is the length of a hex digest for each algorithm we know.
+var digestsizes = map[string]int{}
+
+func init() {
+	for _, a := range algorithms {
+		digestsizes[a.name] = a.new().Size() * 2
+	}
+}
+
+// blake2b only fails to construct with a bad key, and we never use a key.
+func mustBlake2b(h hash.Hash, err error) hash.Hash {
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// newHash returns a hash for alg, or nil if we can not compute it.
+func newHash(alg string) hash.Hash {
+	for _, a := range algorithms {
+		if a.name == alg {
+			return a.new()
+		}
+	}
+	return nil
+}
+
+// strength ranks alg among the algorithms we compute, 0 being the strongest.
+// Algorithms we can not compute rank last.
+func strength(alg string) int {
+	for i, a := range algorithms {
+		if a.name == alg {
+			return i
+		}
+	}
+	return len(algorithms)
+}
+
+// Hasher computes several digests over a single pass of a stream.
+type Hasher struct {
+	names  []string
+	hashes []hash.Hash
+	n      int64
+}
+
+// NewHasher returns a Hasher computing each of algs.
+func NewHasher(algs ...string) (*Hasher, error) {
+	h := &Hasher{}
+	for _, alg := range algs {
+		alg = canonicalAlgorithm(alg)
+		if h.has(alg) {
+			continue
+		}
+		hh := newHash(alg)
+		if hh == nil {
+			return nil, fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		h.names = append(h.names, alg)
+		h.hashes = append(h.hashes, hh)
+	}
+	return h, nil
+}
+
+func (h *Hasher) has(alg string) bool {
+	for _, name := range h.names {
+		if name == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// Write feeds p to every hash.
+func (h *Hasher) Write(p []byte) (int, error) {
+	for _, hh := range h.hashes {
+		hh.Write(p)
+	}
+	h.n += int64(len(p))
+	return len(p), nil
+}
+
+// ReadFrom hashes r until EOF, holding at most hashbufsize bytes at a time.
+func (h *Hasher) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, hashbufsize)
+	var n int64
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			h.Write(buf[:m])
+			n += int64(m)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Len is the number of bytes hashed so far.
+func (h *Hasher) Len() int64 {
+	return h.n
+}
+
+// Sums returns the hex digests computed so far, by algorithm.
+func (h *Hasher) Sums() map[string]string {
+	sums := make(map[string]string, len(h.names))
+	for i, hh := range h.hashes {
+		sums[h.names[i]] = hex.EncodeToString(hh.Sum(nil))
+	}
+	return sums
+}
+
+// parseAlgorithms reads a comma separated list of algorithm names,
+// where "all" stands for every algorithm we can compute.
+func parseAlgorithms(list string) []string {
+	var algs []string
+	for _, alg := range strings.Split(list, ",") {
+		alg = strings.TrimSpace(alg)
+		switch {
+		case alg == "":
+		case strings.EqualFold(alg, "all"):
+			for _, a := range algorithms {
+				algs = append(algs, a.name)
+			}
+		default:
+			algs = append(algs, canonicalAlgorithm(alg))
+		}
+	}
+	return algs
+}
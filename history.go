@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+)
+
+// Observation is one successful fetch of a file from upstream.
+type Observation struct {
+	URL       string            `json:"url"` // canonical, as cacheKey
+	FinalURL  string            `json:"final_url"`
+	Time      time.Time         `json:"time"`
+	Digest    string            `json:"digest"` // SHA256 of what we read
+	Bytes     int64             `json:"bytes"`
+	Truncated bool              `json:"truncated,omitempty"` // read up to our limit, so compared with nothing
+	Headers   map[string]string `json:"headers,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+}
+
+// observedHeaders are the response headers worth keeping.
+var observedHeaders = []string{"Content-Type", "Content-Length", "Etag", "Last-Modified", "Date", "Server"}
+
+// Content is one version of what a URL served.
+type Content struct {
+	Digest    string    `json:"digest"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// HistoryInfo is what we have seen of a URL before.
+type HistoryInfo struct {
+	FirstSeen    time.Time `json:"first_seen"`
+	Observations int       `json:"observations"`
+	// Changed is set when upstream served other content the time before.
+	Changed bool `json:"changed"`
+	// PreviouslySeenDifferent is the latest other content upstream served.
+	PreviouslySeenDifferent *Content `json:"previously_seen_different,omitempty"`
+	// LogIndex is where this fetch is in the log, if we just made it.
+	LogIndex *int64 `json:"log_index,omitempty"`
+}
+
+// urlHistory is what we keep in memory of a URL: each content it served.
+type urlHistory struct {
+	firstSeen    time.Time
+	observations int
+	last         string // digest
+	changed      bool
+	contents     []*Content
+}
+
+// History is a durable record of every fetch, kept in a file of JSON
+// lines, one Observation each, and indexed in memory by URL. The lines
+// are the leaves of a Merkle tree, which makes it a transparency log.
+type History struct {
+	mu      sync.Mutex
+	file    *os.File
+	byURL   map[string]*urlHistory
+	tree    merkleTree                // of the leafHash of each line
+	byHash  map[[sha256.Size]byte]int // where each leafHash first is
+	offsets []int64                   // where each line starts in file
+	size    int64                     // of file
+}
+
+// history records fetches for HashHandler. It is nil, recording nothing,
+// unless enabled by flags.
+var history *History
+
+// OpenHistory opens the history in file, reading what is there.
+func OpenHistory(file string) (*History, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := &History{file: f, byURL: map[string]*urlHistory{}, byHash: map[[sha256.Size]byte]int{}}
+	br := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A line with no end is a write a crash cut short, and not in
+			// the log: drop it, or the next write would run into it
+			if len(line) > 0 {
+				log.Printf("history: %s:%d: dropping %d bytes of a cut short line", file, n, len(line))
+				if err := f.Truncate(h.size); err != nil {
+					f.Close()
+					return nil, err
+				}
+			}
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Every line is in the log, whether we can read it or not
+		line = line[:len(line)-1]
+		h.append(line)
+		var o Observation
+		if err := json.Unmarshal(line, &o); err != nil {
+			log.Printf("history: %s:%d: %v", file, n, err)
+			continue
+		}
+		h.index(&o)
+	}
+	return h, nil
+}
+
+// Len is how many URLs we have seen.
+func (h *History) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.byURL)
+}
+
+// append adds line, which is in file at h.size, to the log.
+func (h *History) append(line []byte) int64 {
+	i := h.tree.size()
+	lh := leafHash(line)
+	if _, ok := h.byHash[lh]; !ok {
+		h.byHash[lh] = i
+	}
+	h.tree.append(lh)
+	h.offsets = append(h.offsets, h.size)
+	h.size += int64(len(line)) + 1
+	return int64(i)
+}
+
+func (h *History) index(o *Observation) *urlHistory {
+	uh := h.byURL[o.URL]
+	if uh == nil {
+		uh = &urlHistory{firstSeen: o.Time}
+		h.byURL[o.URL] = uh
+	}
+	uh.observations++
+	if o.Truncated {
+		return uh
+	}
+	uh.changed = uh.last != "" && uh.last != o.Digest
+	uh.last = o.Digest
+	for _, c := range uh.contents {
+		if c.Digest == o.Digest {
+			c.LastSeen, c.IP = o.Time, o.IP
+			return uh
+		}
+	}
+	uh.contents = append(uh.contents, &Content{o.Digest, o.Time, o.Time, o.IP})
+	return uh
+}
+
+// info is what uh says about content digest. An empty digest, of a
+// truncated read, is compared with nothing.
+func (uh *urlHistory) info(digest string) *HistoryInfo {
+	hi := &HistoryInfo{FirstSeen: uh.firstSeen, Observations: uh.observations}
+	if digest == "" {
+		return hi
+	}
+	hi.Changed = uh.changed && uh.last == digest
+	for _, c := range uh.contents {
+		if c.Digest != digest && (hi.PreviouslySeenDifferent == nil || c.LastSeen.After(hi.PreviouslySeenDifferent.LastSeen)) {
+			prev := *c
+			hi.PreviouslySeenDifferent = &prev
+		}
+	}
+	return hi
+}
+
+// Observe records o, warning if upstream served other content last time.
+func (h *History) Observe(o *Observation) *HistoryInfo {
+	if h == nil {
+		return nil
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		log.Println("history:", err)
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.file.Write(append(b, '\n'))
+	if err == nil {
+		err = h.file.Sync()
+	}
+	if err != nil {
+		// Leave nothing that is not in the log for the next to run into,
+		// and remember nothing that is not in the file
+		log.Println("history:", err)
+		if err := h.file.Truncate(h.size); err != nil {
+			log.Println("history:", err)
+		}
+		if uh := h.byURL[o.URL]; uh != nil {
+			return uh.info(o.comparable())
+		}
+		return nil
+	}
+	leaf := h.append(b)
+	var last string
+	if uh := h.byURL[o.URL]; uh != nil {
+		last = uh.last
+	}
+	uh := h.index(o)
+	if uh.changed && !o.Truncated {
+		log.Printf("CHANGED: %s now has SHA256 %s, was %s", o.URL, o.Digest, last)
+	}
+	hi := uh.info(o.comparable())
+	hi.LogIndex = &leaf
+	return hi
+}
+
+// Info is what we have seen before of the URL with key, which now has
+// content digest, or "" if truncated, without recording anything.
+func (h *History) Info(key, digest string) *HistoryInfo {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh := h.byURL[key]
+	if uh == nil {
+		return nil
+	}
+	return uh.info(digest)
+}
+
+// observation starts an Observation of resp, whose body has digest.
+func observation(key string, resp *http.Response, digest string, n int64, truncated bool, ip string) *Observation {
+	o := &Observation{
+		URL:       key,
+		FinalURL:  resp.Request.URL.String(),
+		Time:      time.Now().UTC(),
+		Digest:    digest,
+		Bytes:     n,
+		Truncated: truncated,
+		Headers:   map[string]string{},
+		IP:        ip,
+	}
+	for _, name := range observedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			o.Headers[name] = v
+		}
+	}
+	return o
+}
+
+// comparable is the digest of o to compare with others, or "" if it was
+// truncated.
+func (o *Observation) comparable() string {
+	if o.Truncated {
+		return ""
+	}
+	return o.Digest
+}
+
+// remoteAddr notes the address a fetch last connected to.
+type remoteAddr struct {
+	mu sync.Mutex
+	ip string
+}
+
+func (a *remoteAddr) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ip
+}
+
+// withRemoteAddr returns a context under which fetches note the address
+// they connect to, redirects included, in the returned remoteAddr.
+func withRemoteAddr(ctx context.Context) (context.Context, *remoteAddr) {
+	a := new(remoteAddr)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String())
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.ip = host
+			a.mu.Unlock()
+		},
+	}), a
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// digests as published in pages: hex, or base64 after a label as in
+	// subresource integrity ("sha256-...")
+	hexdigest   = regexp.MustCompile(`\b[0-9A-Fa-f]{32,128}\b`)
+	b64digest   = regexp.MustCompile(`(?i)\b(sha(?:256|384|512))[-:=][ \t]*([A-Za-z0-9+/]{43,86}={0,2})`)
+	b64unlabled = regexp.MustCompile(`(?:^|[^A-Za-z0-9+/])([A-Za-z0-9+/]{43}=|[A-Za-z0-9+/]{86}==)(?:$|[^A-Za-z0-9+/=])`)
+
+	// algorithm labels, as in table headers or "SHA-256: ..."
+	algorithmLabel = regexp.MustCompile(`(?i)\b(sha3-(?:224|256|384|512)|sha-?(?:1|224|256|384|512)|sha512/256|md5|blake2b(?:-(?:256|384|512))?)\b`)
+
+	// pageFilename looks like a downloadable file, not a page
+	pageFilename = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+~-]*\.[A-Za-z0-9]{1,8}$`)
+)
+
+// pageExtensions are links to more pages, not files.
+var pageExtensions = map[string]bool{
+	".html": true, ".htm": true, ".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".shtml": true,
+}
+
+// pageToken is a run of text, or a link, in a page, with where it sits.
+type pageToken struct {
+	text   string
+	link   bool // text is the base name of a link's target
+	row    int  // table row, list item or other block it is in
+	col    int  // table column, or -1
+	header bool // in a table header cell
+}
+
+// pageFile returns s as a file name, if it looks like one.
+func pageFile(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !pageFilename.MatchString(s) || pageExtensions[strings.ToLower(path.Ext(s))] {
+		return "", false
+	}
+	if hexdigest.MatchString(s) {
+		return "", false
+	}
+	return s, true
+}
+
+// tokenizePage reads a page into text and link tokens, noting the rows and
+// columns they are in. Scripts and styles are skipped.
+func tokenizePage(r io.Reader) []pageToken {
+	var (
+		toks []pageToken
+		row  int
+		col  = -1
+		th   bool
+		skip int
+	)
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return toks
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.DataAtom {
+			case atom.Script, atom.Style, atom.Noscript, atom.Template:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Tr:
+				row++
+				col = -1
+			case atom.Td, atom.Th:
+				col++
+				th = t.DataAtom == atom.Th
+			case atom.Li, atom.P, atom.Dt, atom.Div, atom.Section, atom.Article, atom.Pre,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				row++
+				col = -1
+			case atom.Br:
+				if col < 0 {
+					row++
+				}
+			case atom.A:
+				for _, a := range t.Attr {
+					if a.Key != "href" {
+						continue
+					}
+					u, err := url.Parse(a.Val)
+					if err != nil {
+						continue
+					}
+					if name, ok := pageFile(path.Base(u.Path)); ok {
+						toks = append(toks, pageToken{name, true, row, col, th})
+					}
+				}
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			switch t.DataAtom {
+			case atom.Script, atom.Style, atom.Noscript, atom.Template:
+				if skip > 0 {
+					skip--
+				}
+			case atom.Th, atom.Td:
+				th = false
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			// Preformatted text is often a checksum file pasted in: a row
+			// per line
+			for i, line := range strings.Split(string(z.Text()), "\n") {
+				if i > 0 {
+					row++
+				}
+				if line = strings.TrimSpace(line); line != "" {
+					toks = append(toks, pageToken{line, false, row, col, th})
+				}
+			}
+		}
+	}
+}
+
+// pageDigest is a digest found in a page, in hex, and any algorithm it was
+// labeled with.
+type pageDigest struct {
+	hex   string
+	label string
+	at    int // where in its text it starts
+	end   int // and ends
+}
+
+// findDigests returns the digests in text.
+func findDigests(text string) []pageDigest {
+	var found []pageDigest
+	for _, m := range hexdigest.FindAllStringIndex(text, -1) {
+		d := text[m[0]:m[1]]
+		if hexsizes[len(d)] != "" {
+			found = append(found, pageDigest{strings.ToLower(d), "", m[0], m[1]})
+		}
+	}
+	for _, m := range b64digest.FindAllStringSubmatchIndex(text, -1) {
+		b, err := base64.StdEncoding.DecodeString(text[m[4]:m[5]])
+		alg := canonicalAlgorithm(strings.ToUpper(text[m[2]:m[3]]))
+		if err == nil && digestsizes[alg] == len(b)*2 {
+			found = append(found, pageDigest{hex.EncodeToString(b), alg, m[0], m[1]})
+		}
+	}
+	if len(found) == 0 {
+		for _, m := range b64unlabled.FindAllStringSubmatchIndex(text, -1) {
+			b, err := base64.StdEncoding.DecodeString(text[m[2]:m[3]])
+			if err == nil {
+				found = append(found, pageDigest{hex.EncodeToString(b), "", m[2], m[3]})
+			}
+		}
+	}
+	return found
+}
+
+// lastLabel returns the last algorithm named in s that makes digests of
+// size hex chars.
+func lastLabel(s string, size int) string {
+	labels := algorithmLabel.FindAllString(s, -1)
+	for i := len(labels) - 1; i >= 0; i-- {
+		alg := canonicalAlgorithm(strings.ToUpper(labels[i]))
+		if digestsizes[alg] == size {
+			return alg
+		}
+	}
+	return ""
+}
+
+// fileNear finds the file the digest d in toks[i] belongs to: named
+// around it in the same text, elsewhere in its row, or if it is labeled
+// with its algorithm, just before or after. Links beat plain text.
+func fileNear(toks []pageToken, i int, d pageDigest, labeled bool) *pageToken {
+	t := toks[i]
+	trim := func(s string) string { return strings.Trim(s, "()[]:=*,") }
+	if words := strings.Fields(t.text[:d.at]); len(words) > 0 {
+		if name, ok := pageFile(trim(words[len(words)-1])); ok {
+			return &pageToken{text: name, row: t.row}
+		}
+	}
+	if words := strings.Fields(t.text[d.end:]); len(words) > 0 {
+		if name, ok := pageFile(trim(words[0])); ok {
+			return &pageToken{text: name, row: t.row}
+		}
+	}
+
+	var file *pageToken
+	consider := func(j int) {
+		if file != nil && (file.link || !toks[j].link) {
+			return
+		}
+		// The whole text, or the last word of it naming a file
+		name, ok := pageFile(toks[j].text)
+		if !ok {
+			for _, w := range strings.Fields(toks[j].text) {
+				if n, isfile := pageFile(trim(w)); isfile {
+					name, ok = n, true
+				}
+			}
+		}
+		if ok {
+			f := toks[j]
+			f.text = name
+			file = &f
+		}
+	}
+	for j := i - 1; j >= 0 && j >= i-8 && toks[j].row == t.row; j-- {
+		consider(j)
+	}
+	for j := i + 1; j < len(toks) && j <= i+2 && toks[j].row == t.row; j++ {
+		consider(j)
+	}
+	// An unlabeled hex string in a row of its own is more likely something
+	// else than the digest of a file in another
+	if !labeled {
+		return file
+	}
+	for j := i - 1; file == nil && j >= 0 && j >= i-3; j-- {
+		consider(j)
+	}
+	if file == nil && i+1 < len(toks) {
+		consider(i + 1)
+	}
+	return file
+}
+
+// minConfidence is the least confidence in an entry extracted from a page
+// that an artifact is verified against.
+const minConfidence = 0.5
+
+// ExtractChecksums finds the digests published in an HTML page, such as a
+// download page's table of files and their SHA-256s, with the file each
+// belongs to and the algorithm it was made with. As pages are not made to
+// be read by us, each entry comes with a confidence from 0 to 1: highest
+// for a digest labeled with its algorithm in the same table row as a
+// link to its file, lowest for one whose algorithm we guessed. A digest
+// with neither a file nor an algorithm named is left out.
+func ExtractChecksums(r io.Reader, hint string) []Entry {
+	hint = algorithmHint(hint)
+	toks := tokenizePage(r)
+
+	// Column headers name the algorithm of the cells below them
+	headers := map[int]string{}
+	var entries []Entry
+	seen := map[string]bool{}
+	for i, t := range toks {
+		if t.header {
+			headers[t.col] = t.text
+			continue
+		}
+		for _, d := range findDigests(t.text) {
+			size := len(d.hex)
+			confidence := 0.2
+
+			// The algorithm: labeled, in the column header, or nearby
+			alg := d.label
+			if alg == "" {
+				alg = lastLabel(t.text[:d.at], size)
+			}
+			if alg == "" && t.col >= 0 {
+				alg = lastLabel(headers[t.col], size)
+			}
+			for j := i - 1; alg == "" && j >= 0 && j >= i-3 && toks[j].row >= t.row-1; j-- {
+				alg = lastLabel(toks[j].text, size)
+			}
+
+			file := fileNear(toks, i, d, alg != "")
+			switch {
+			case file != nil && file.row == t.row:
+				confidence += 0.4
+			case file != nil:
+				confidence += 0.2
+			}
+			if file != nil && file.link {
+				confidence += 0.1
+			}
+
+			// A lone hex string with neither is more likely a request ID
+			// in an error page than a digest; with a file, guess the
+			// algorithm from its size
+			if alg != "" {
+				confidence += 0.3
+			} else if file == nil {
+				continue
+			} else if alg = guessAlgorithm(d.hex, hint); alg == "" {
+				continue
+			}
+			confidence = math.Min(1, math.Round(confidence*100)/100)
+
+			e := Entry{Algorithm: alg, Digest: d.hex, Confidence: confidence}
+			if file != nil {
+				e.Filename = file.text
+			}
+			key := e.Algorithm + " " + e.Filename + " " + e.Digest
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractChecksums(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    string
+		entries []Entry
+	}{
+		{
+			name: "table, and a request ID",
+			page: `<table><tr><td><a href="/dl/foo-1.2.zip">foo-1.2.zip</a></td><td>` + sha256foo + `</td></tr></table>` +
+				`<p>Request ID: ` + md5foo + `</p>`,
+			entries: []Entry{{Algorithm: "SHA256", Filename: "foo-1.2.zip", Digest: sha256foo, Confidence: 0.7}},
+		},
+		{
+			name: "table with headers",
+			page: `<table><tr><th>File</th><th>MD5</th></tr>` +
+				`<tr><td><a href="foo-1.2.tgz">foo-1.2.tgz</a></td><td>` + md5foo + `</td></tr></table>`,
+			entries: []Entry{{Algorithm: "MD5", Filename: "foo-1.2.tgz", Digest: md5foo, Confidence: 1}},
+		},
+		{
+			name:    "labeled, under its link",
+			page:    `<p><a href="https://example.org/foo-1.2.tar.gz">Download</a></p><p>SHA-256: ` + sha256foo + `</p>`,
+			entries: []Entry{{Algorithm: "SHA256", Filename: "foo-1.2.tar.gz", Digest: sha256foo, Confidence: 0.8}},
+		},
+		{
+			name: "pasted checksum file",
+			page: "<pre>" + sha256foo + "  foo-1.2.tar.gz\n" + sha1foo + "  bar-1.0.zip\n</pre>",
+			entries: []Entry{
+				{Algorithm: "SHA256", Filename: "foo-1.2.tar.gz", Digest: sha256foo, Confidence: 0.6},
+				{Algorithm: "SHA1", Filename: "bar-1.0.zip", Digest: sha1foo, Confidence: 0.6},
+			},
+		},
+		{
+			name:    "subresource integrity",
+			page:    `<p>foo.js sha256-LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=</p>`,
+			entries: []Entry{{Algorithm: "SHA256", Filename: "foo.js", Digest: sha256foo, Confidence: 0.9}},
+		},
+		{
+			name: "error page",
+			page: `<html><body><h1>Not Found</h1><p>` + md5foo + `</p></body></html>`,
+		},
+		{
+			name: "script",
+			page: `<script>var h = "` + sha256foo + `"; // foo.tar.gz</script>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := ExtractChecksums(strings.NewReader(tt.page), "/download.html")
+			if !reflect.DeepEqual(entries, tt.entries) {
+				t.Errorf("entries\n got %+v\nwant %+v", entries, tt.entries)
+			}
+		})
+	}
+}
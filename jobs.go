@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job states.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a request run in the background, for artifacts too large to
+// hash while the client waits.
+type Job struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Request  url.Values `json:"request"` // what a POST to / takes
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Restarts int        `json:"restarts,omitempty"` // times a restart of ours cut it short
+
+	Bytes      int64   `json:"bytes"`           // of the artifact hashed so far
+	Total      int64   `json:"total,omitempty"` // of the artifact, if upstream said
+	Throughput float64 `json:"throughput"`      // bytes a second
+
+	Result *HashResponse `json:"result,omitempty"`
+	Error  *APIError     `json:"error,omitempty"`
+
+	cancel   context.CancelFunc
+	progress *progress
+}
+
+// progress counts the bytes of an artifact as they are hashed.
+type progress struct {
+	total, done atomic.Int64
+}
+
+type progressKey struct{}
+
+// withProgress returns a context under which verifyArtifact counts what
+// it hashes in p.
+func withProgress(ctx context.Context, p *progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// countProgress starts counting the artifact read from r, of total bytes
+// or -1 if unknown, in the progress of ctx, if there is one.
+func countProgress(ctx context.Context, r io.Reader, total int64) io.Reader {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	if p == nil {
+		return r
+	}
+	if total > 0 {
+		p.total.Store(total)
+	}
+	return &progressReader{r, p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.done.Add(int64(n))
+	return n, err
+}
+
+// Jobs queues jobs for -job-workers to run, one at a time each, and keeps
+// them until ttl after they finish. With a dir, it keeps them there too,
+// to run those a restart cut short.
+type Jobs struct {
+	mu    sync.Mutex
+	dir   string
+	ttl   time.Duration
+	jobs  map[string]*Job
+	queue chan *Job
+}
+
+// jobs serves the /jobs endpoints.
+var jobs *Jobs
+
+var errQueueFull = errors.New("too many jobs queued")
+
+// NewJobs returns a job queue of at most size jobs, loading whatever is in
+// dir, and starts workers to run them.
+func NewJobs(dir string, size, workers int, ttl time.Duration) (*Jobs, error) {
+	js := &Jobs{dir: dir, ttl: ttl, jobs: map[string]*Job{}, queue: make(chan *Job, size)}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		var pending []*Job
+		for _, f := range files {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			j := new(Job)
+			if err := json.Unmarshal(b, j); err != nil || j.ID == "" {
+				log.Println("jobs: dropping", f, err)
+				os.Remove(f)
+				continue
+			}
+			js.jobs[j.ID] = j
+			if j.State == JobCancelled && j.Finished == nil {
+				// Cancelled while running, and cut short before it finished
+				js.finish(j)
+			}
+			if j.State == JobRunning {
+				j.State, j.Started, j.Bytes, j.Total, j.Throughput = JobQueued, nil, 0, 0, 0
+				j.Restarts++
+			}
+			if j.State == JobQueued {
+				pending = append(pending, j)
+			}
+		}
+		// In the order they came
+		sort.Slice(pending, func(i, k int) bool { return pending[i].Created.Before(pending[k].Created) })
+		for _, j := range pending {
+			select {
+			case js.queue <- j:
+				js.save(j)
+			default:
+				j.State = JobFailed
+				j.Error = newAPIError(http.StatusServiceUnavailable, CodeQueueFull, errQueueFull.Error())
+				js.finish(j)
+			}
+		}
+	}
+	for n := 0; n < workers; n++ {
+		go js.work()
+	}
+	go js.sweep()
+	return js, nil
+}
+
+// Len is how many jobs we hold, and how many of those are yet to run.
+func (js *Jobs) Len() (int, int) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return len(js.jobs), len(js.queue)
+}
+
+// save writes j to dir, if there is one. The caller holds js.mu, or has
+// j to itself.
+func (js *Jobs) save(j *Job) {
+	if js.dir == "" {
+		return
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		log.Println("jobs:", err)
+		return
+	}
+	name := filepath.Join(js.dir, j.ID+".json")
+	if err := ioutil.WriteFile(name+".tmp", b, 0600); err != nil {
+		log.Println("jobs:", err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.Println("jobs:", err)
+	}
+}
+
+// finish marks j finished now and saves it, with js.mu held.
+func (js *Jobs) finish(j *Job) {
+	now := time.Now().UTC()
+	j.Finished = &now
+	if j.progress != nil {
+		j.Bytes, j.Total = j.progress.done.Load(), j.progress.total.Load()
+	}
+	if j.Started != nil {
+		if d := now.Sub(*j.Started).Seconds(); d > 0 {
+			j.Throughput = float64(j.Bytes) / d
+		}
+	}
+	j.cancel, j.progress = nil, nil
+	js.save(j)
+}
+
+// Submit queues a job for form, which must already parse.
+func (js *Jobs) Submit(form url.Values) (*Job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	j := &Job{ID: hex.EncodeToString(id), State: JobQueued, Request: form, Created: time.Now().UTC()}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	select {
+	case js.queue <- j:
+	default:
+		return nil, errQueueFull
+	}
+	js.jobs[j.ID] = j
+	js.save(j)
+	return j, nil
+}
+
+// Get returns a copy of the job with id, as it is now, or nil.
+func (js *Jobs) Get(id string) *Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.view(js.jobs[id])
+}
+
+// view is a copy of j with its progress so far, with js.mu held.
+func (js *Jobs) view(j *Job) *Job {
+	if j == nil {
+		return nil
+	}
+	v := *j
+	if p := j.progress; p != nil {
+		v.Bytes, v.Total = p.done.Load(), p.total.Load()
+		if d := time.Since(*j.Started).Seconds(); d > 0 {
+			v.Throughput = float64(v.Bytes) / d
+		}
+	}
+	return &v
+}
+
+// Cancel stops the job with id, unless it already finished, and returns
+// it as Get does.
+func (js *Jobs) Cancel(id string) *Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j := js.jobs[id]
+	if j == nil {
+		return nil
+	}
+	switch j.State {
+	case JobQueued:
+		j.State = JobCancelled
+		js.finish(j)
+	case JobRunning:
+		// The worker finishes it again when it stops; a restart before
+		// then must neither run it again nor keep it forever
+		now := time.Now().UTC()
+		j.State, j.Finished = JobCancelled, &now
+		j.cancel()
+		js.save(j)
+	}
+	return js.view(j)
+}
+
+// work runs queued jobs, one at a time.
+func (js *Jobs) work() {
+	for j := range js.queue {
+		js.mu.Lock()
+		if j.State != JobQueued {
+			js.mu.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		now := time.Now().UTC()
+		j.State, j.Started, j.cancel, j.progress = JobRunning, &now, cancel, new(progress)
+		ctx = withProgress(ctx, j.progress)
+		form := j.Request
+		js.save(j)
+		js.mu.Unlock()
+
+		log.Println("Job", j.ID, "running")
+		var resp *HashResponse
+		req, err := parseJobRequest(form)
+		if err == nil {
+			resp, err = requester.Do(ctx, req)
+		}
+
+		js.mu.Lock()
+		var e *APIError
+		switch {
+		case j.State == JobCancelled:
+		case err == nil:
+			j.State, j.Result = JobDone, resp
+		case errors.As(err, &e):
+			j.State, j.Error = JobFailed, e
+		default:
+			j.State, j.Error = JobFailed, newAPIError(http.StatusInternalServerError, CodeInternal, err.Error())
+		}
+		js.finish(j)
+		log.Println("Job", j.ID, j.State)
+		js.mu.Unlock()
+		cancel()
+	}
+}
+
+// sweep forgets jobs ttl after they finish.
+func (js *Jobs) sweep() {
+	for range time.Tick(time.Minute) {
+		js.mu.Lock()
+		for id, j := range js.jobs {
+			if j.Finished != nil && time.Since(*j.Finished) > js.ttl {
+				delete(js.jobs, id)
+				if js.dir != "" {
+					os.Remove(filepath.Join(js.dir, id+".json"))
+				}
+			}
+		}
+		js.mu.Unlock()
+	}
+}
+
+// parseJobRequest reads a job's request as HashHandler does, but with
+// -job-timeout to fetch and hash the artifact.
+func parseJobRequest(form url.Values) (*HashRequest, error) {
+	r := &http.Request{Form: form, PostForm: form}
+	req, err := parseHashRequest(r, limitsFor("/jobs"))
+	if err != nil {
+		return nil, err
+	}
+	_, server := serverDeadlines()
+	server.Total = *jobtimeout
+	if req.ArtifactDeadlines, err = requestDeadlines(r, "artifact_", server); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	return req, nil
+}
+
+// jobRequest checks there are jobs to ask about.
+func jobRequest() error {
+	if jobs == nil {
+		return newAPIError(http.StatusNotFound, CodeNoJobs, "this server runs no jobs; start it with -job-workers")
+	}
+	return nil
+}
+
+// JobSubmitHandler takes what a POST to / takes, and queues it as a job,
+// answering 202 Accepted with the job and where to follow it.
+func JobSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if err := jobRequest(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error()))
+		return
+	}
+	// Refuse now what would fail to parse later
+	if _, err := parseJobRequest(r.Form); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	j, err := jobs.Submit(r.Form)
+	if errors.Is(err, errQueueFull) {
+		writeError(w, r, newAPIError(http.StatusServiceUnavailable, CodeQueueFull, err.Error()))
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	log.Printf("JOB: %s from %s - %s", j.ID, r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(jobs.Get(j.ID)); err != nil {
+		log.Println(err)
+	}
+}
+
+// JobHandler returns the job with the id in the path, as it is now.
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	if err := jobRequest(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	j := jobs.Get(mux.Vars(r)["id"])
+	if j == nil {
+		writeError(w, r, newAPIError(http.StatusNotFound, CodeNoSuchJob, "no job "+mux.Vars(r)["id"]))
+		return
+	}
+	writeJSON(w, j)
+}
+
+// JobCancelHandler cancels the job with the id in the path, and returns it.
+func JobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if err := jobRequest(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	j := jobs.Cancel(mux.Vars(r)["id"])
+	if j == nil {
+		writeError(w, r, newAPIError(http.StatusNotFound, CodeNoSuchJob, "no job "+mux.Vars(r)["id"]))
+		return
+	}
+	log.Println("Job", j.ID, "cancel:", j.State)
+	writeJSON(w, j)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobsCancelRunning(t *testing.T) {
+	js, err := NewJobs(t.TempDir(), 10, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := false
+	js.jobs["a"] = &Job{ID: "a", State: JobRunning, cancel: func() { cancelled = true }}
+	j := js.Cancel("a")
+	if !cancelled || j.State != JobCancelled || j.Finished == nil {
+		t.Errorf("cancelled %v, job %+v", cancelled, j)
+	}
+}
+
+func TestJobsLoadCancelled(t *testing.T) {
+	dir := t.TempDir()
+	b, err := json.Marshal(&Job{ID: "a", State: JobCancelled, Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.json"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	js, err := NewJobs(dir, 10, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := js.Get("a"); j == nil || j.State != JobCancelled || j.Finished == nil {
+		t.Fatalf("job %+v, want cancelled and finished", j)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "a.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Job
+	if err := json.Unmarshal(b, &saved); err != nil || saved.Finished == nil {
+		t.Errorf("saved %s, %v", b, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// nodeKey is who we are: it signs our tree heads and attestations. It is
+// from -key.
+var nodeKey ed25519.PrivateKey
+
+// loadNodeKey reads the Ed25519 key in file, a base64 seed, making one if
+// there is none.
+func loadNodeKey(file string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+		if err := os.WriteFile(file, []byte(seed), 0600); err != nil {
+			return nil, err
+		}
+		log.Println("Made a new key in", file)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not a base64 Ed25519 seed", file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signifyPublicKey is pub as a signify public key file, so that anyone can
+// check our tree heads with signify -V.
+func signifyPublicKey(pub ed25519.PublicKey) string {
+	num := keyNum(pub)
+	blob := append([]byte(signifyAlg), num[:]...)
+	blob = append(blob, pub...)
+	return signifyComment + "checksigd public key\n" + base64.StdEncoding.EncodeToString(blob) + "\n"
+}
+
+// keyNum is the signify key number we give pub: the start of its SHA256.
+func keyNum(pub ed25519.PublicKey) (num [signifyKeyNum]byte) {
+	sum := sha256.Sum256(pub)
+	copy(num[:], sum[:])
+	return num
+}
+
+// KeyHandler returns the key we sign with, as a signify public key.
+func KeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, signifyPublicKey(nodeKey.Public().(ed25519.PublicKey)))
+}
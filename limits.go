@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits bound what one request may make us read.
+type Limits struct {
+	Body int64 // bytes of checksum file
+	Sig  int64 // bytes of signature file
+	URL  int   // chars of any URL given
+}
+
+// endpointLimits are limits for particular endpoints, from -endpoint-limits,
+// over those set by the other flags.
+var endpointLimits = map[string]Limits{}
+
+// serverLimits are the limits set by flags.
+func serverLimits() Limits {
+	return Limits{Body: *maxbytes, Sig: *maxsigsize, URL: *maxurlsize}
+}
+
+// limitsFor returns the limits for requests to path.
+func limitsFor(path string) Limits {
+	if l, ok := endpointLimits[path]; ok {
+		return l
+	}
+	return serverLimits()
+}
+
+// parseEndpointLimits reads ";" separated "path:name=value,..." overrides,
+// such as "/:max-bytes=65536,max-url-size=512", on top of server.
+func parseEndpointLimits(list string, server Limits) (map[string]Limits, error) {
+	m := map[string]Limits{}
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		path, settings, ok := strings.Cut(s, ":")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("endpoint limits %q: want /path:name=value,...", s)
+		}
+		l := server
+		for _, kv := range strings.Split(settings, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("endpoint limits %q: bad %s %q", s, name, value)
+			}
+			switch name {
+			case "max-bytes":
+				l.Body = n
+			case "max-sig-size":
+				l.Sig = n
+			case "max-url-size":
+				l.URL = int(n)
+			default:
+				return nil, fmt.Errorf("endpoint limits %q: unknown limit %q", s, name)
+			}
+		}
+		m[path] = l
+	}
+	return m, nil
+}
+
+// errTruncated is why a signature over a checksum file cut off at limit
+// cannot be checked.
+func errTruncated(limit int64) error {
+	return fmt.Errorf("checksum file is over %d bytes, its signature cannot be checked", limit)
+}
+
+// lineLimitReader reads whole lines from r until the next would take it
+// past limit bytes, then stops as at EOF and reports Truncated. A file cut
+// off mid-line could otherwise parse as a shorter filename.
+type lineLimitReader struct {
+	r         *bufio.Reader
+	limit     int64
+	n         int64
+	buf       []byte
+	Truncated bool
+}
+
+func newLineLimitReader(r *bufio.Reader, limit int64) *lineLimitReader {
+	return &lineLimitReader{r: r, limit: limit}
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if len(l.buf) == 0 {
+		if l.Truncated {
+			return 0, io.EOF
+		}
+		line, err := l.r.ReadSlice('\n')
+		for err == bufio.ErrBufferFull && l.n+int64(len(l.buf)+len(line)) <= l.limit {
+			l.buf = append(l.buf, line...)
+			line, err = l.r.ReadSlice('\n')
+		}
+		l.buf = append(l.buf, line...)
+		switch {
+		case l.n+int64(len(l.buf)) > l.limit:
+			l.buf = nil
+			l.Truncated = true
+			return 0, io.EOF
+		case err != nil && err != io.EOF:
+			return 0, err
+		case len(l.buf) == 0:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	l.n += int64(n)
+	return n, nil
+}
+
+// N is how many bytes have been read.
+func (l *lineLimitReader) N() int64 {
+	return l.n
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineLimitReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		limit     int64
+		out       string
+		truncated bool
+	}{
+		{"under", "a\nbb\n", 10, "a\nbb\n", false},
+		{"at", "a\nbb\n", 5, "a\nbb\n", false},
+		{"cut at the last whole line", "a\nbb\nccc\n", 6, "a\nbb\n", true},
+		{"cut inside the first line", "aaaaaaaa\nb\n", 4, "", true},
+		{"no last newline", "a\nbb", 10, "a\nbb", false},
+		{"no last newline, over", "a\nbbbb", 4, "a\n", true},
+		{"empty", "", 10, "", false},
+		// Longer than the reader's buffer, so read in pieces
+		{"long lines", strings.Repeat("x", 40) + "\n" + strings.Repeat("y", 40) + "\n", 60, strings.Repeat("x", 40) + "\n", true},
+		{"long lines, under", strings.Repeat("x", 40) + "\n" + strings.Repeat("y", 40) + "\n", 82, strings.Repeat("x", 40) + "\n" + strings.Repeat("y", 40) + "\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lr := newLineLimitReader(bufio.NewReaderSize(strings.NewReader(tt.in), 16), tt.limit)
+			b, err := io.ReadAll(lr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.out {
+				t.Errorf("read %q, want %q", b, tt.out)
+			}
+			if lr.Truncated != tt.truncated {
+				t.Errorf("truncated %v, want %v", lr.Truncated, tt.truncated)
+			}
+			if lr.N() != int64(len(tt.out)) {
+				t.Errorf("N %d, want %d", lr.N(), len(tt.out))
+			}
+		})
+	}
+}
+
+func TestParseEndpointLimits(t *testing.T) {
+	server := Limits{Body: 1 << 20, Sig: 64 << 10, URL: 2048}
+	tests := []struct {
+		list string
+		want map[string]Limits
+		err  bool
+	}{
+		{"", map[string]Limits{}, false},
+		{"/batch:max-bytes=4096", map[string]Limits{"/batch": {4096, 64 << 10, 2048}}, false},
+		{"/:max-bytes=65536,max-url-size=512;/peer:max-sig-size=1024", map[string]Limits{
+			"/":     {65536, 64 << 10, 512},
+			"/peer": {1 << 20, 1024, 2048},
+		}, false},
+		{"/:max-bytes=-1", nil, true},
+		{"/:bogus=1", nil, true},
+		{"nocolon", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := parseEndpointLimits(tt.list, server)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want one: %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for path, l := range tt.want {
+				if got[path] != l {
+					t.Errorf("%s: got %+v, want %+v", path, got[path], l)
+				}
+			}
+		})
+	}
+}
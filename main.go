@@ -10,17 +10,19 @@ https://github.com/aerth/checksigd
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"strings"
 
 	"github.com/gorilla/mux"
 
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
-	"net/url"
 
 	"github.com/microcosm-cc/bluemonday"
 
@@ -31,10 +33,7 @@ import (
 var version = "git"
 
 const (
-	maxbytes   = 256 // our buffer limit is 256 bytes per request.
-	maxurlsize = 127 // we grab from urls no longer than 127 chars
-	maxtimeget = 3   // seconds
-	text       = "text/plain"
+	maxtimeget = 3 // seconds
 	htmlhead   = `
 	<!DOCTYPE html>
     <html>
@@ -57,7 +56,7 @@ const (
 	homepage = htmlhead + logolink + htmlfoot
 )
 
-//usage shows how available flags.
+// usage shows how available flags.
 func usage() {
 	fmt.Println("checksigd - version " + version)
 	fmt.Println("\nusage: checksigd [flags]")
@@ -72,8 +71,67 @@ var (
 	//	fastcgi = flag.Bool("fastcgi", false, "use fastcgi with nginx")
 	bind = flag.String("bind", "127.0.0.1", "default: 127.0.0.1 - maybe 0.0.0.0 ?")
 	help = flag.Bool("help", false, "show usage help and quit")
+
+	keyringfile  = flag.String("keyring", "", "OpenPGP public keys (armored or binary) to verify signatures with")
+	signifyfile  = flag.String("signify", "", "signify public keys to verify signatures with, comma separated")
+	minisignfile = flag.String("minisign", "", "file of \"domain publickey\" lines, the minisign keys trusted per domain")
+
+	timeout         = flag.Duration("timeout", maxtimeget*time.Second, "longest time to fetch a checksum or signature file")
+	artifacttimeout = flag.Duration("artifact-timeout", 10*time.Minute, "longest time to fetch and hash an artifact")
+	dialtimeout     = flag.Duration("dial-timeout", maxtimeget*time.Second, "longest time to connect upstream")
+	tlstimeout      = flag.Duration("tls-timeout", maxtimeget*time.Second, "longest time for a TLS handshake upstream")
+	headertimeout   = flag.Duration("header-timeout", maxtimeget*time.Second, "longest time to wait for upstream response headers")
+
+	deny  = flag.String("deny", "", "networks never to fetch from, comma separated CIDRs, on top of loopback, private, link-local and multicast")
+	allow = flag.String("allow", "", "networks to fetch from even though they are denied, comma separated CIDRs")
+
+	maxredirects   = flag.Int("max-redirects", 5, "most redirects to follow for any one fetch")
+	allowdowngrade = flag.Bool("allow-downgrade", false, "follow redirects from https to http")
+	samesite       = flag.Bool("same-site", false, "only follow redirects within the registrable domain fetched first")
+
+	maxbytes      = flag.Int64("max-bytes", 1<<20, "largest checksum file we read, in bytes; larger ones are cut at the last whole line and reported truncated")
+	maxsigsize    = flag.Int64("max-sig-size", 64<<10, "largest signature file we read, in bytes")
+	maxurlsize    = flag.Int("max-url-size", 2048, "longest URL we take, in chars")
+	endpointlimit = flag.String("endpoint-limits", "", "limits for particular endpoints, as \"/path:max-bytes=N,max-sig-size=N,max-url-size=N;...\"")
+
+	cachesize  = flag.Int("cache-size", 1024, "how many checksum and signature files to cache, 0 for none")
+	cachebytes = flag.Int64("cache-bytes", 32<<20, "how many bytes of checksum and signature files to cache")
+	cachettl   = flag.Duration("cache-ttl", 10*time.Minute, "how long a cached file is served before asking upstream whether it changed")
+	cachedir   = flag.String("cache-dir", "", "directory to keep the cache in across restarts")
+
+	historyfile = flag.String("history", "", "file to record every fetch in, and to tell from when content behind a URL changes; served as a transparency log at /log/")
+	peerlist    = flag.String("peers", "", "other checksigd servers to ask for the same checksum files, comma separated URLs")
+	peerkeys    = flag.String("peer-keys", "", "file of \"peer publickey\" lines, pinning peers to the keys they must sign with")
+	quorum      = flag.Int("quorum", 0, "how many pinned peers must agree with us for a checksum file to be verified, 0 for no quorum")
+	keyfile     = flag.String("key", "", "file holding this server's Ed25519 key, to sign attestations and the log with; made if missing")
+
+	batchworkers = flag.Int("batch-workers", 8, "how many items of a batch to work on at once")
+	batchperhost = flag.Int("batch-per-host", 2, "how many items of batches, or discovery probes, may fetch from any one host at once")
+
+	jobworkers = flag.Int("job-workers", 2, "how many jobs to run at once, 0 for no /jobs")
+	jobqueue   = flag.Int("job-queue", 1000, "most jobs waiting to run")
+	jobtimeout = flag.Duration("job-timeout", 6*time.Hour, "longest time a job may take to fetch and hash an artifact")
+	jobttl     = flag.Duration("job-ttl", 24*time.Hour, "how long to keep a job after it finishes")
+	jobsdir    = flag.String("jobs-dir", "", "directory to keep jobs in, to run them across restarts")
+
+	extracthtml  = flag.Bool("extract-html", true, "extract digests published in HTML pages, for requests with html=1")
+	contenttypes = flag.String("content-types", defaultContentTypes, "media types we take checksum files as, comma separated, with parameters they must have (text/plain;charset=utf-8) or wildcards (text/*)")
 )
 
+// serverDeadlines are the deadlines for fetching a checksum or signature
+// file, and for fetching an artifact, as set by flags.
+func serverDeadlines() (doc, artifact Deadlines) {
+	doc = Deadlines{Dial: *dialtimeout, TLS: *tlstimeout, Header: *headertimeout, Total: *timeout}
+	artifact = doc
+	artifact.Total = *artifacttimeout
+	return doc, artifact
+}
+
+// serverRedirectPolicy is the redirect policy set by flags.
+func serverRedirectPolicy() RedirectPolicy {
+	return RedirectPolicy{MaxHops: *maxredirects, AllowDowngrade: *allowdowngrade, SameSite: *samesite}
+}
+
 // Return the domain the user requested us at
 func getDomain(r *http.Request) string {
 	type Domains map[string]http.Handler
@@ -82,7 +140,7 @@ func getDomain(r *http.Request) string {
 	return requesthost
 }
 
-//getLink returns the requested bind:port or http://bind:port string
+// getLink returns the requested bind:port or http://bind:port string
 func getLink(bind string, port string) string {
 
 	link := "http://" + bind + ":" + port
@@ -110,10 +168,30 @@ func main() {
 	r.HandleFunc("/", HashHandler).
 		Methods("POST")
 
+	r.HandleFunc("/batch", BatchHandler).Methods("POST")
+
+	// Jobs, for artifacts too large to wait for
+	r.HandleFunc("/jobs", JobSubmitHandler).Methods("POST")
+	r.HandleFunc("/jobs/{id}", JobHandler).Methods("GET")
+	r.HandleFunc("/jobs/{id}", JobCancelHandler).Methods("DELETE")
+
+	// Peers ask us what we see
+	r.HandleFunc("/peer", PeerHandler).Methods("POST")
+
+	// The key we sign attestations and the log with
+	r.HandleFunc("/.well-known/checksigd.pub", KeyHandler).Methods("GET")
+
+	// Transparency log
+	r.HandleFunc("/log/sth", LogHeadHandler).Methods("GET")
+	r.HandleFunc("/log/key", KeyHandler).Methods("GET")
+	r.HandleFunc("/log/proof", LogProofHandler).Methods("GET")
+	r.HandleFunc("/log/consistency", LogConsistencyHandler).Methods("GET")
+	r.HandleFunc("/log/entries", LogEntriesHandler).Methods("GET")
+
 	http.Handle("/", r)
 	//End Routing
 
-	log.Printf("[checksigd version " + version + "] live on " + getLink(*bind, *port))
+	log.Printf("[checksigd version %s] live on %s", version, getLink(*bind, *port))
 
 	if *debug == false {
 		log.Println("[switching logs to debug.log]")
@@ -121,12 +199,118 @@ func main() {
 	} else {
 		log.Println("Debug on: [not using debug.log]")
 	}
+
+	loadTemplates()
+
+	// Only connect where strangers may send us
+	extra, err := parseCIDRs(*deny)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deniedNets = append(deniedNets, extra...)
+	if allowedNets, err = parseCIDRs(*allow); err != nil {
+		log.Fatal(err)
+	}
+
+	// How much we read, per endpoint
+	if endpointLimits, err = parseEndpointLimits(*endpointlimit, serverLimits()); err != nil {
+		log.Fatal(err)
+	}
+
+	// What we take checksum files as
+	if contentTypes, err = parseContentTypes(*contenttypes); err != nil {
+		log.Fatal(err)
+	}
+
+	if peers, err = parsePeers(*peerlist); err != nil {
+		log.Fatal(err)
+	}
+	if *peerkeys != "" {
+		if peers, err = loadPeerKeys(*peerkeys, peers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pinned := 0
+	for _, p := range peers {
+		if p.Key != nil {
+			pinned++
+		}
+	}
+	if *quorum > pinned {
+		log.Fatalf("-quorum %d, but only %d pinned peers", *quorum, pinned)
+	}
+	if len(peers) > 0 {
+		log.Printf("Asking %d peers, %d pinned, quorum %d", len(peers), pinned, *quorum)
+	}
+
+	if *batchworkers < 1 || *batchperhost < 1 {
+		log.Fatal("-batch-workers and -batch-per-host must be at least 1")
+	}
+
+	// Bound every upstream connection, whatever the request asks for
+	tr.DialContext = (&safeDialer{&net.Dialer{Timeout: *dialtimeout}, net.DefaultResolver}).DialContext
+	tr.TLSHandshakeTimeout = *tlstimeout
+	tr.ResponseHeaderTimeout = *headertimeout
+
+	if *cachesize > 0 && *cachebytes > 0 {
+		if cache, err = NewCache(*cachesize, *cachebytes, *cachettl, *cachedir); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Cache: %d files loaded, %d max, %d bytes max, revalidated after %s", cache.lru.Len(), *cachesize, *cachebytes, *cachettl)
+	}
+
+	if *historyfile != "" {
+		if history, err = OpenHistory(*historyfile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("History of %d URLs in %s, a log of %d entries", history.Len(), *historyfile, history.tree.size())
+	}
+
+	if *keyfile != "" {
+		if nodeKey, err = loadNodeKey(*keyfile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("No -key: signing with a key we forget on exit")
+		if _, nodeKey, err = ed25519.GenerateKey(nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Signing with %s", base64.StdEncoding.EncodeToString(nodeKey.Public().(ed25519.PublicKey)))
+
+	if *jobworkers > 0 {
+		if jobs, err = NewJobs(*jobsdir, *jobqueue, *jobworkers, *jobttl); err != nil {
+			log.Fatal(err)
+		}
+		held, queued := jobs.Len()
+		log.Printf("Jobs: %d workers, %d jobs loaded, %d queued", *jobworkers, held, queued)
+	}
+
+	if *keyringfile != "" {
+		keyring, err = loadKeyring(*keyringfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d keys from %s", len(keyring), *keyringfile)
+	}
+	if *signifyfile != "" {
+		if err := loadSignifyKeys(*signifyfile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d signify keys", len(signifyKeys))
+	}
+	if *minisignfile != "" {
+		if err := loadMinisignKeys(*minisignfile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded minisign keys for %d domains", len(minisignKeys))
+	}
 	// Start Serving!
 	log.Fatal(http.ListenAndServe(":"+*port, r))
 
 }
 
-//  checksigd blank page (tm)
+// checksigd blank page (tm)
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	p := bluemonday.UGCPolicy()
 	domain := getDomain(r)
@@ -142,16 +326,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// not implemented yet
-type HashRequest struct {
-	url  string
-	hash string
-}
-
-type HashRequester struct {
-}
-
-// Transport
+// Transport, which never goes through a proxy: we check where we connect.
 var tr = &http.Transport{
 	DisableCompression: true,
 }
@@ -162,13 +337,8 @@ var apigun = &http.Client{
 	Transport:     tr,
 }
 
-// Keep useragent on redirect
-func redirectPolicyFunc(req *http.Request, reqs []*http.Request) error {
-	req.Header.Set("User-Agent", "checksigd/0.1")
-	return nil
-}
-
-// HashHandler parses a POST request, gets and returns the first 1024 bytes.
+// HashHandler parses a POST request, gets the checksum file at url and
+// returns the entries found in it.
 func HashHandler(w http.ResponseWriter, r *http.Request) {
 
 	domain := getDomain(r)
@@ -185,81 +355,33 @@ func HashHandler(w http.ResponseWriter, r *http.Request) {
 		r.Host,
 		r.UserAgent())
 
-	// Parse the user's request.
-	r.ParseForm()
-
 	// Typical request:
 	// curl -d url=<http://example.com/md5.txt> https://checksigd.example.org
-	//	if r.FormValue("url") != "" {
-
-	// Check if it is a URL
-	sigurl, err := url.Parse(r.FormValue("url"))
+	req, err := parseHashRequest(r, limitsFor(r.URL.Path))
 	if err != nil {
-		log.Println("errrrr")
-		log.Println(err)
+		writeError(w, r, err)
 		return
 	}
 
-	if len(sigurl.String()) > maxurlsize {
-		log.Println("Too long.")
-		log.Println(len(sigurl.String()), " > ", maxurlsize)
+	response, err := requester.Do(r.Context(), req)
+	if r.Context().Err() != nil {
+		log.Println(errClientGone)
 		return
 	}
-
-	// todo:
-	// log.Println("Asking peers")
-	// askpeers(r.FormValue("url"))
-
-	// Create http request to send
-	log.Println("Grabbing", sigurl)
-	zr := &http.Request{
-		Method: "GET",
-		URL:    sigurl,
-		Header: http.Header{
-			"User-Agent": {"checksigd/0.1"},
-		},
-	}
-
-	// Limit to 1MiB
-	//	zr.Body = http.MaxBytesReader(w, zr.Body, 1024)
-
-	// Send request to alien server
-	resp, err := apigun.Do(zr)
 	if err != nil {
-		log.Println(err)
+		writeError(w, r, err)
 		return
 	}
 
-	// Log header
-	// log.Println(resp.Header)
-
-	// Check content-type header var for text/plain
-	if http.CanonicalHeaderKey(resp.Header.Get("content-type")) != text {
-		log.Printf("Not giving it! %s != %s", http.CanonicalHeaderKey(resp.Header.Get("content-type")), text)
-		return
-	} else {
-		log.Println("Looks good!")
-	}
-	// Limit grab into mem
-	resp.Body = http.MaxBytesReader(w, resp.Body, maxbytes)
-
-	// Limit our response
-	out := io.LimitReader(resp.Body, maxbytes)
-
-	// Copy bytes from temporary buffer to browser/curl
-	if _, err := io.Copy(w, out); err != nil {
+	// Send entries to browser/curl
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Println(err)
 		return
 	}
 
 	// If we made it this far, we ran into no problems.
 	log.Println("Gave signature.")
-	return
-
-	//	}
-
-	//	fmt.Fprintf(w, "yo dawg, you were tryin to check the hash...\n")
-
 }
 
 // RedirectHomeHandler redirects everyone home ("/") with a 301 redirect.
@@ -276,7 +398,7 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-//OpenLogFile switches the log engine to a file, rather than stdout
+// OpenLogFile switches the log engine to a file, rather than stdout
 func OpenLogFile() {
 	f, err := os.OpenFile("./debug.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// Merkle trees as in RFC 6962, section 2.1: leaves are hashed with a 0 byte
+// before them, nodes with a 1, so that neither can pass for the other.
+
+var errBadTreeSize = errors.New("bad tree size")
+
+func leafHash(b []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte{0}, b...))
+}
+
+func nodeHash(l, r [sha256.Size]byte) [sha256.Size]byte {
+	b := make([]byte, 1, 1+2*sha256.Size)
+	b[0] = 1
+	b = append(append(b, l[:]...), r[:]...)
+	return sha256.Sum256(b)
+}
+
+// split is the largest power of two smaller than n, where the tree of n
+// leaves splits in two.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleTree holds the hashed leaves of a log, and the hash of every
+// complete subtree of them, level by level, as they are appended: level k
+// holds MTH of each run of 2^k leaves starting at a multiple of 2^k. As
+// RFC 6962 splits trees, every left subtree is one of those, so the hash
+// of any tree takes log n of them rather than hashing all n leaves again.
+type merkleTree struct {
+	levels [][][sha256.Size]byte
+}
+
+// size is how many leaves t has.
+func (t *merkleTree) size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// append adds leaf, hashing every subtree it completes.
+func (t *merkleTree) append(leaf [sha256.Size]byte) {
+	h, i := leaf, t.size()
+	for k := 0; ; k++ {
+		if k == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		t.levels[k] = append(t.levels[k], h)
+		if i%2 == 0 {
+			return
+		}
+		h, i = nodeHash(t.levels[k][i-1], h), i/2
+	}
+}
+
+// snapshot is t as it is now. Hashes never change once there, so it may
+// be used while t grows.
+func (t *merkleTree) snapshot() *merkleTree {
+	s := &merkleTree{levels: make([][][sha256.Size]byte, len(t.levels))}
+	for k, l := range t.levels {
+		s.levels[k] = l[:len(l):len(l)]
+	}
+	return s
+}
+
+// hash is MTH(D[lo:hi]).
+func (t *merkleTree) hash(lo, hi int) [sha256.Size]byte {
+	n := hi - lo
+	if n == 0 {
+		return sha256.Sum256(nil)
+	}
+	if n&(n-1) == 0 && lo%n == 0 {
+		k := 0
+		for 1<<k < n {
+			k++
+		}
+		return t.levels[k][lo/n]
+	}
+	k := split(n)
+	return nodeHash(t.hash(lo, lo+k), t.hash(lo+k, hi))
+}
+
+// root is MTH(D[n]), the hash of the tree of the first n leaves.
+func (t *merkleTree) root(n int) [sha256.Size]byte {
+	return t.hash(0, n)
+}
+
+// inclusionProof is PATH(m, D[n]): the hashes that, with leaf m, make the
+// hash of the tree of the first n leaves.
+func (t *merkleTree) inclusionProof(m, n int) ([][sha256.Size]byte, error) {
+	if n < 0 || n > t.size() || m < 0 || m >= n {
+		return nil, errBadTreeSize
+	}
+	var path [][sha256.Size]byte
+	lo, hi := 0, n
+	for hi-lo > 1 {
+		k := split(hi - lo)
+		if m < lo+k {
+			path = append(path, t.hash(lo+k, hi))
+			hi = lo + k
+		} else {
+			path = append(path, t.hash(lo, lo+k))
+			lo += k
+		}
+	}
+	// Built from the root down; the proof goes from the leaf up
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// consistencyProof is PROOF(m, D[n]): the hashes that show the tree of the
+// first m leaves is where the tree of the first n started.
+func (t *merkleTree) consistencyProof(m, n int) ([][sha256.Size]byte, error) {
+	if n > t.size() || m < 1 || m > n {
+		return nil, errBadTreeSize
+	}
+	return t.subproof(m, 0, n, true), nil
+}
+
+// subproof is SUBPROOF(m, D[lo:hi], b).
+func (t *merkleTree) subproof(m, lo, hi int, b bool) [][sha256.Size]byte {
+	n := hi - lo
+	if m == n {
+		if b {
+			return nil
+		}
+		return [][sha256.Size]byte{t.hash(lo, hi)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(t.subproof(m, lo, lo+k, b), t.hash(lo+k, hi))
+	}
+	return append(t.subproof(m-k, lo+k, hi, false), t.hash(lo, lo+k))
+}
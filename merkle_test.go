@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// mth is MTH(D[n]) hashed the slow way, straight from RFC 6962.
+func mth(leaves [][sha256.Size]byte) [sha256.Size]byte {
+	switch n := len(leaves); n {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	default:
+		k := split(n)
+		return nodeHash(mth(leaves[:k]), mth(leaves[k:]))
+	}
+}
+
+// verifyInclusion checks an inclusion proof as RFC 9162, section 2.1.3.2
+// says a client does.
+func verifyInclusion(m, n int, leaf, root [sha256.Size]byte, path [][sha256.Size]byte) bool {
+	if m >= n {
+		return false
+	}
+	fn, sn := m, n-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			if fn&1 == 0 {
+				for fn&1 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && r == root
+}
+
+// verifyConsistency checks a consistency proof as RFC 9162, section
+// 2.1.4.2 says a client does.
+func verifyConsistency(m, n int, first, second [sha256.Size]byte, path [][sha256.Size]byte) bool {
+	if m == n {
+		return len(path) == 0 && first == second
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if m&(m-1) == 0 {
+		path = append([][sha256.Size]byte{first}, path...)
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			if fn&1 == 0 {
+				for fn&1 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && fr == first && sr == second
+}
+
+func testTree(n int) (*merkleTree, [][sha256.Size]byte) {
+	var t merkleTree
+	var leaves [][sha256.Size]byte
+	for i := 0; i < n; i++ {
+		h := leafHash([]byte(fmt.Sprint("leaf ", i)))
+		t.append(h)
+		leaves = append(leaves, h)
+	}
+	return &t, leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	tree, leaves := testTree(70)
+	for n := 0; n <= len(leaves); n++ {
+		if tree.root(n) != mth(leaves[:n]) {
+			t.Errorf("root(%d) is not MTH of %d leaves", n, n)
+		}
+	}
+}
+
+func TestMerkleSnapshot(t *testing.T) {
+	tree, _ := testTree(5)
+	s := tree.snapshot()
+	root := s.root(5)
+	for i := 0; i < 10; i++ {
+		tree.append(leafHash([]byte{byte(i)}))
+	}
+	if s.size() != 5 || s.root(5) != root {
+		t.Error("snapshot changed as the tree grew")
+	}
+}
+
+func TestMerkleInclusionProof(t *testing.T) {
+	tree, leaves := testTree(40)
+	for n := 1; n <= len(leaves); n++ {
+		root := tree.root(n)
+		for m := 0; m < n; m++ {
+			path, err := tree.inclusionProof(m, n)
+			if err != nil {
+				t.Fatalf("inclusionProof(%d, %d): %v", m, n, err)
+			}
+			if !verifyInclusion(m, n, leaves[m], root, path) {
+				t.Errorf("inclusionProof(%d, %d) does not verify", m, n)
+			}
+			if m > 0 && verifyInclusion(m-1, n, leaves[m], root, path) {
+				t.Errorf("inclusionProof(%d, %d) verifies for leaf %d", m, n, m-1)
+			}
+		}
+	}
+}
+
+func TestMerkleConsistencyProof(t *testing.T) {
+	tree, _ := testTree(40)
+	for n := 1; n <= tree.size(); n++ {
+		second := tree.root(n)
+		for m := 1; m <= n; m++ {
+			path, err := tree.consistencyProof(m, n)
+			if err != nil {
+				t.Fatalf("consistencyProof(%d, %d): %v", m, n, err)
+			}
+			if !verifyConsistency(m, n, tree.root(m), second, path) {
+				t.Errorf("consistencyProof(%d, %d) does not verify", m, n)
+			}
+			if m < n && verifyConsistency(m, n, tree.root(m), tree.root(n-1), path) {
+				t.Errorf("consistencyProof(%d, %d) verifies against the wrong root", m, n)
+			}
+		}
+	}
+}
+
+// TestMerkleVectors checks hashes against the test vectors used by
+// Certificate Transparency implementations.
+func TestMerkleVectors(t *testing.T) {
+	inputs := []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+	roots := []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+	var tree merkleTree
+	for i, in := range inputs {
+		b, _ := hex.DecodeString(in)
+		tree.append(leafHash(b))
+		if got := fmt.Sprintf("%x", tree.root(i+1)); got != roots[i] {
+			t.Errorf("root of %d leaves %s, want %s", i+1, got, roots[i])
+		}
+	}
+	if tree.root(0) != sha256.Sum256(nil) {
+		t.Errorf("empty root %x", tree.root(0))
+	}
+}
+
+func TestMerkleBadTreeSize(t *testing.T) {
+	tree, _ := testTree(4)
+	tests := []struct {
+		name string
+		f    func() error
+	}{
+		{"inclusion past the end", func() error { _, err := tree.inclusionProof(0, 5); return err }},
+		{"inclusion of leaf n", func() error { _, err := tree.inclusionProof(4, 4); return err }},
+		{"inclusion of negative leaf", func() error { _, err := tree.inclusionProof(-1, 4); return err }},
+		{"consistency from 0", func() error { _, err := tree.consistencyProof(0, 4); return err }},
+		{"consistency backwards", func() error { _, err := tree.consistencyProof(3, 2); return err }},
+		{"consistency past the end", func() error { _, err := tree.consistencyProof(2, 5); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.f(); err != errBadTreeSize {
+				t.Errorf("error %v, want %v", err, errBadTreeSize)
+			}
+		})
+	}
+}
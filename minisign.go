@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign signatures are signify framing plus a trusted comment, covered by
+// a second (global) signature. "Ed" signs the message itself, "ED" signs its
+// BLAKE2b-512 hash.
+const (
+	minisignTrusted  = "trusted comment: "
+	minisignLegacy   = "Ed"
+	minisignPrehash  = "ED"
+	minisignKeyIDLen = 8
+)
+
+// minisignKey is a trusted minisign public key.
+type minisignKey struct {
+	id  [minisignKeyIDLen]byte
+	key ed25519.PublicKey
+}
+
+// minisignKeys are the keys we trust, by the domain they sign for, loaded
+// from the -minisign flag. The domain "*" applies everywhere.
+var minisignKeys = map[string][]minisignKey{}
+
+// minisig is a parsed .minisig file.
+type minisig struct {
+	alg     string
+	id      [minisignKeyIDLen]byte
+	sig     []byte
+	trusted string
+	global  []byte
+}
+
+// isMinisign reports whether b looks like a minisign signature.
+func isMinisign(b []byte) bool {
+	lines := bytes.SplitN(b, []byte("\n"), 4)
+	return isSignify(b) && len(lines) >= 3 && bytes.HasPrefix(lines[2], []byte(minisignTrusted))
+}
+
+// minisignKeyID formats a key ID the way minisign prints it.
+func minisignKeyID(id [minisignKeyIDLen]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// parseMinisignKey reads a public key in its base64 form, as given to
+// minisign -P.
+func parseMinisignKey(s string) (minisignKey, error) {
+	var k minisignKey
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, err
+	}
+	if len(b) != 2+minisignKeyIDLen+ed25519.PublicKeySize || string(b[:2]) != minisignLegacy {
+		return k, errors.New("unsupported minisign public key")
+	}
+	copy(k.id[:], b[2:])
+	k.key = ed25519.PublicKey(b[2+minisignKeyIDLen:])
+	return k, nil
+}
+
+// loadMinisignKeys reads file, where each line names a domain and the
+// base64 public key trusted for files fetched from it:
+//
+//	ziglang.org RWSGOq2NVecA2UPNdBUZykf1CCb147pkmdtYxgb3Ti+JO/wCYvhbAb/U
+func loadMinisignKeys(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want domain and key", file, n)
+		}
+		k, err := parseMinisignKey(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		domain := strings.ToLower(fields[0])
+		minisignKeys[domain] = append(minisignKeys[domain], k)
+	}
+	return scanner.Err()
+}
+
+// minisignKeysFor returns the keys trusted for host: those configured for
+// it or a parent domain, and those configured for "*".
+func minisignKeysFor(host string) []minisignKey {
+	host = strings.ToLower(host)
+	var keys []minisignKey
+	for domain, k := range minisignKeys {
+		if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+			keys = append(keys, k...)
+		}
+	}
+	return keys
+}
+
+// parseMinisig reads a .minisig file.
+func parseMinisig(b []byte) (*minisig, error) {
+	if !isMinisign(b) {
+		return nil, errors.New("not a minisign signature")
+	}
+	lines := strings.SplitN(string(b), "\n", 5)
+	if len(lines) < 4 {
+		return nil, errors.New("truncated minisign signature")
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) != 2+minisignKeyIDLen+ed25519.SignatureSize {
+		return nil, errors.New("unsupported minisign signature")
+	}
+	m := &minisig{alg: string(blob[:2])}
+	if m.alg != minisignLegacy && m.alg != minisignPrehash {
+		return nil, fmt.Errorf("unsupported minisign algorithm %q", m.alg)
+	}
+	copy(m.id[:], blob[2:])
+	m.sig = blob[2+minisignKeyIDLen:]
+	m.trusted = strings.TrimSuffix(strings.TrimPrefix(lines[2], minisignTrusted), "\r")
+	m.global, err = base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return nil, err
+	}
+	if len(m.global) != ed25519.SignatureSize {
+		return nil, errors.New("bad minisign global signature")
+	}
+	return m, nil
+}
+
+// prehashed reports whether the signature is over the BLAKE2b-512 hash of
+// the message rather than the message itself.
+func (m *minisig) prehashed() bool {
+	return m.alg == minisignPrehash
+}
+
+// verify checks the signature against the keys trusted for host. signed is
+// the message for a legacy signature, or its BLAKE2b-512 digest for a
+// prehashed one.
+func (m *minisig) verify(host string, signed []byte) *Signature {
+	s := &Signature{Scheme: "minisign", KeyID: minisignKeyID(m.id)}
+	var key *minisignKey
+	for _, k := range minisignKeysFor(host) {
+		if k.id == m.id {
+			key = &k
+			break
+		}
+	}
+	if key == nil {
+		s.Error = fmt.Sprintf("unknown key %s for %s", s.KeyID, host)
+		return s
+	}
+	s.Fingerprint = base64.StdEncoding.EncodeToString(key.key)
+
+	if !ed25519.Verify(key.key, signed, m.sig) {
+		s.Error = "signature verification failed"
+		return s
+	}
+	// The trusted comment is only trusted once the global signature holds.
+	if !ed25519.Verify(key.key, append(append([]byte{}, m.sig...), m.trusted...), m.global) {
+		s.Error = "trusted comment verification failed"
+		return s
+	}
+	s.TrustedComment = m.trusted
+	s.Valid = true
+	return s
+}
+
+// verifyMinisign checks the minisign signature sig over msg, which was
+// fetched from host.
+func verifyMinisign(msg, sig []byte, host string) *Signature {
+	m, err := parseMinisig(sig)
+	if err != nil {
+		return &Signature{Scheme: "minisign", Error: err.Error()}
+	}
+	if m.prehashed() {
+		sum := blake2b.Sum512(msg)
+		return m.verify(host, sum[:])
+	}
+	return m.verify(host, msg)
+}
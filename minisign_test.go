@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSig makes a .minisig over msg by key id, as minisign writes it,
+// prehashed for alg "ED".
+func minisignSig(priv ed25519.PrivateKey, alg string, id [minisignKeyIDLen]byte, msg []byte, trusted string) []byte {
+	signed := msg
+	if alg == minisignPrehash {
+		sum := blake2b.Sum512(msg)
+		signed = sum[:]
+	}
+	sig := ed25519.Sign(priv, signed)
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+	blob := append(append([]byte(alg), id[:]...), sig...)
+	return []byte(signifyComment + "signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(blob) + "\n" +
+		minisignTrusted + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	id := [minisignKeyIDLen]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	saved := minisignKeys
+	minisignKeys = map[string][]minisignKey{"example.org": {{id, pub}}}
+	defer func() { minisignKeys = saved }()
+
+	msg := []byte(sha256foo + "  foo\n")
+	trusted := "timestamp:1700000000\tfile:foo.sha256"
+	valid := minisignSig(priv, minisignPrehash, id, msg, trusted)
+	tampered := strings.Replace(string(valid), "file:foo", "file:bar", 1)
+	badalg := minisignSig(priv, "Ex", id, msg, trusted)
+
+	tests := []struct {
+		name string
+		msg  []byte
+		sig  []byte
+		host string
+		err  string
+	}{
+		{"prehashed", msg, valid, "example.org", ""},
+		{"legacy", msg, minisignSig(priv, minisignLegacy, id, msg, trusted), "example.org", ""},
+		{"subdomain", msg, valid, "dl.example.org", ""},
+		{"other host", msg, valid, "example.com", "unknown key 0807060504030201 for example.com"},
+		{"unknown key", msg, minisignSig(priv, minisignPrehash, [minisignKeyIDLen]byte{}, msg, trusted), "example.org", "unknown key 0000000000000000 for example.org"},
+		{"wrong key", msg, minisignSig(other, minisignPrehash, id, msg, trusted), "example.org", "signature verification failed"},
+		{"changed message", append([]byte("x"), msg...), valid, "example.org", "signature verification failed"},
+		{"changed trusted comment", msg, []byte(tampered), "example.org", "trusted comment verification failed"},
+		{"unknown algorithm", msg, badalg, "example.org", `unsupported minisign algorithm "Ex"`},
+		{"not minisign", msg, signifySig(priv, id, msg), "example.org", "not a minisign signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := verifyMinisign(tt.msg, tt.sig, tt.host)
+			if s.Valid != (tt.err == "") || s.Error != tt.err {
+				t.Errorf("valid %v, error %q, want error %q", s.Valid, s.Error, tt.err)
+			}
+			if s.Valid != (s.TrustedComment == trusted) {
+				t.Errorf("trusted comment %q", s.TrustedComment)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPeerResponse is the most we read of a peer's answer.
+const maxPeerResponse = 16 << 20
+
+// Peer is another checksigd server we ask for the same checksum file, to
+// see it from where it is. A peer pinned to a Key must sign what it says.
+type Peer struct {
+	URL *url.URL
+	Key ed25519.PublicKey
+}
+
+// peers are from -peers and -peer-keys.
+var peers []*Peer
+
+// peerClient asks peers. They are ours, so unlike upstream they may be
+// on any network.
+var peerClient = &http.Client{Timeout: time.Minute}
+
+func parsePeerURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad peer %q", s)
+	}
+	return u, nil
+}
+
+// parsePeers reads a comma separated list of peer URLs.
+func parsePeers(list string) ([]*Peer, error) {
+	var ps []*Peer
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := parsePeerURL(s)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, &Peer{URL: u})
+	}
+	return ps, nil
+}
+
+// loadPeerKeys reads file, where each line names a peer and the key it
+// signs with, the second line of its /.well-known/checksigd.pub, and pins
+// the peers to them, adding those not in ps:
+//
+//	https://checksigd.example.org RWRw+VQ1K45JQD7MSccOGztZwXyG0BfxZqd2jlF7XaN1l2fj2Sv/hkIG
+func loadPeerKeys(file string, ps []*Peer) ([]*Peer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want peer and key", file, n)
+		}
+		u, err := parsePeerURL(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		// The same layout as a minisign key
+		k, err := parseMinisignKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		var p *Peer
+		for _, q := range ps {
+			if q.URL.String() == u.String() {
+				p = q
+			}
+		}
+		if p == nil {
+			p = &Peer{URL: u}
+			ps = append(ps, p)
+		}
+		p.Key = k.key
+	}
+	return ps, scanner.Err()
+}
+
+// PeerResult is what a peer saw of the checksum file. Authenticated is
+// set when a pinned peer signed it for this request; a pinned peer that
+// did not is an Error. Evidence is what a disagreeing peer signed.
+type PeerResult struct {
+	Peer          string     `json:"peer"`
+	SHA256        string     `json:"sha256,omitempty"`
+	FinalURL      string     `json:"final_url,omitempty"`
+	Fetched       *time.Time `json:"fetched,omitempty"` // when upstream last gave it to the peer
+	Truncated     bool       `json:"truncated,omitempty"`
+	Authenticated bool       `json:"authenticated"`
+	Agree         bool       `json:"agree"`
+	Evidence      *Envelope  `json:"evidence,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// Consensus is what the peers make of the checksum file we fetched. With
+// no quorum, all that answered agree with us, some disagree, or none
+// answered. With one, it is verified if at least that many authenticated
+// peers agree, unverified if not.
+type Consensus struct {
+	Verdict  string       `json:"verdict"` // agree, disagree, unavailable, verified or unverified
+	Agree    int          `json:"agree"`
+	Disagree int          `json:"disagree"`
+	Verified int          `json:"verified"` // authenticated peers that agree
+	Quorum   int          `json:"quorum,omitempty"`
+	Peers    []PeerResult `json:"peers"`
+}
+
+// askPeers asks every peer, at once, for the checksum file req names, and
+// returns a channel that gets their answers.
+func askPeers(ctx context.Context, req *HashRequest) <-chan []PeerResult {
+	ch := make(chan []PeerResult, 1)
+	results := make([]PeerResult, len(peers))
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *Peer) {
+			defer wg.Done()
+			results[i] = askPeer(ctx, p, req, hex.EncodeToString(nonce))
+		}(i, p)
+	}
+	go func() {
+		wg.Wait()
+		ch <- results
+	}()
+	return ch
+}
+
+// askPeer asks p at /peer what it sees of the checksum file req names.
+// It answers with a Statement it signed, which must carry nonce, so
+// that it cannot be an old one.
+func askPeer(ctx context.Context, p *Peer, req *HashRequest, nonce string) PeerResult {
+	res := PeerResult{Peer: p.URL.String()}
+	form := url.Values{
+		"url":           {req.URL.String()},
+		"nonce":         {nonce},
+		"nocache":       {strconv.FormatBool(req.NoCache)},
+		"max_redirects": {strconv.Itoa(req.Redirects.MaxHops)},
+		"same_site":     {strconv.FormatBool(req.Redirects.SameSite)},
+		"html":          {strconv.FormatBool(req.HTML)},
+		"max_bytes":     {strconv.FormatInt(req.Limits.Body, 10)},
+	}
+	if req.Deadlines.Total > 0 {
+		form.Set("timeout", req.Deadlines.Total.String())
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Deadlines.Total+time.Second)
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", p.URL.JoinPath("peer").String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("User-Agent", "checksigd/0.1")
+	resp, err := peerClient.Do(r)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Envelope
+		Error *APIError `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPeerResponse)).Decode(&answer); err != nil {
+		res.Error = fmt.Sprintf("%s: %v", resp.Status, err)
+		return res
+	}
+	if answer.Error != nil {
+		res.Error = answer.Error.Error()
+		return res
+	}
+
+	// What it says, and whether we know it said it
+	st, err := answer.Envelope.Open(p.Key)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	switch {
+	case st.Nonce != nonce:
+		res.Error = "statement is not for this request"
+		return res
+	case st.URL != req.URL.String():
+		res.Error = "statement is for " + st.URL
+		return res
+	}
+	res.Authenticated = p.Key != nil
+	res.SHA256, res.FinalURL, res.Fetched = st.Digest, st.FinalURL, &st.Fetched
+	res.Truncated = st.Verdict.Truncated
+	if res.Authenticated {
+		res.Evidence = &answer.Envelope
+	}
+	return res
+}
+
+// PeerHandler answers a peer's askPeer: it fetches the checksum file as
+// HashHandler does, reading no more than the peer does, without asking
+// peers of its own, and returns a signed Statement of what it saw.
+func PeerHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("PEER: %s %s", r.RemoteAddr, r.UserAgent())
+	req, err := parseHashRequest(r, limitsFor(r.URL.Path))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if v := r.FormValue("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad max_bytes %q", v)))
+			return
+		}
+		// Peers can only ask for less
+		if n < req.Limits.Body {
+			req.Limits.Body = n
+		}
+	}
+	if req.URL == nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadURL, "url is required"))
+		return
+	}
+	if len(req.Nonce) > 64 {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, "nonce over 64 chars"))
+		return
+	}
+	req.Sig, req.Artifact, req.ArtifactSig = nil, nil, nil
+	req.NoPeers, req.Attest = true, true
+
+	response, err := requester.Do(r.Context(), req)
+	if r.Context().Err() != nil {
+		log.Println(errClientGone)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, response.Attestation)
+}
+
+// consensus compares what peers saw with digest, what we saw, needing
+// quorum authenticated peers to agree, if any. What was cut short at a
+// limit, by us or a peer, depends on the limit and is compared with
+// nothing.
+func consensus(digest string, truncated bool, results []PeerResult, quorum int) *Consensus {
+	c := &Consensus{Peers: results, Quorum: quorum}
+	for i := range c.Peers {
+		p := &c.Peers[i]
+		if p.Error != "" {
+			continue
+		}
+		if truncated || p.Truncated {
+			p.Evidence = nil
+			continue
+		}
+		if p.Agree = p.SHA256 == digest; p.Agree {
+			c.Agree++
+			if p.Authenticated {
+				c.Verified++
+			}
+			// Only disagreement needs showing
+			p.Evidence = nil
+		} else {
+			c.Disagree++
+			log.Printf("DISAGREE: %s saw SHA256 %s of %s, we saw %s", p.Peer, p.SHA256, p.FinalURL, digest)
+		}
+	}
+	switch {
+	case quorum > 0 && c.Verified >= quorum:
+		c.Verdict = "verified"
+	case quorum > 0:
+		c.Verdict = "unverified"
+	case c.Disagree > 0:
+		c.Verdict = "disagree"
+	case c.Agree > 0:
+		c.Verdict = "agree"
+	default:
+		c.Verdict = "unavailable"
+	}
+	return c
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// keyring holds the OpenPGP keys we trust, loaded from the -keyring flag.
+var keyring openpgp.EntityList
+
+// loadKeyring reads the armored or binary OpenPGP public keys in file.
+func loadKeyring(file string) (openpgp.EntityList, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if isArmored(b) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
+
+// isArmored reports whether b starts with an ASCII armor header.
+func isArmored(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN PGP "))
+}
+
+// dearmor returns the binary packets in b, which may be armored.
+func dearmor(b []byte) ([]byte, error) {
+	if !isArmored(b) {
+		return b, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(block.Body)
+}
+
+// verifyPGP checks the detached OpenPGP signature sig over signed against
+// our keyring, and reports who made it, when, and whether it is still good.
+func verifyPGP(signed, sig []byte) *Signature {
+	s := &Signature{Scheme: "pgp"}
+	if len(keyring) == 0 {
+		s.Error = "no keyring configured"
+		return s
+	}
+
+	raw, err := dearmor(sig)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	return checkPGP(s, signed, raw)
+}
+
+// checkPGP checks the binary OpenPGP signature raw over signed, filling in s.
+func checkPGP(s *Signature, signed, raw []byte) *Signature {
+	// Read the signature packet for its issuer and lifetime.
+	p, err := packet.Read(bytes.NewReader(raw))
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	sp, ok := p.(*packet.Signature)
+	if !ok {
+		s.Error = "not a signature"
+		return s
+	}
+	if sp.IssuerKeyId == nil {
+		s.Error = "signature has no issuer"
+		return s
+	}
+	issuer := *sp.IssuerKeyId
+	created := sp.CreationTime
+	s.Created = &created
+	if sp.SigLifetimeSecs != nil && *sp.SigLifetimeSecs != 0 {
+		expires := created.Add(time.Duration(*sp.SigLifetimeSecs) * time.Second)
+		s.Expires = &expires
+	}
+	s.KeyID = fmt.Sprintf("%016X", issuer)
+
+	keys := keyring.KeysById(issuer)
+	if len(keys) == 0 {
+		s.Error = "unknown key " + s.KeyID
+		return s
+	}
+	key := keys[0]
+	s.Fingerprint = fmt.Sprintf("%X", key.PublicKey.Fingerprint)
+	if id := key.Entity.PrimaryIdentity(); id != nil {
+		s.Signer = id.Name
+	}
+
+	// The key must have been good when it signed, not still be now: release
+	// signatures outlive the keys that made them.
+	config := &packet.Config{Time: func() time.Time { return created }}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(raw), config)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+
+	// A good signature from a key that was dead when it was made is no good.
+	if err := pgpValidity(signer, key, s); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Valid = true
+	return s
+}
+
+// pgpValidity checks the signature and the key that made it have not expired
+// or been revoked.
+func pgpValidity(signer *openpgp.Entity, key openpgp.Key, s *Signature) error {
+	now := time.Now()
+	if s.Expires != nil && now.After(*s.Expires) {
+		return errors.New("signature expired")
+	}
+	if len(signer.Revocations) > 0 {
+		return errors.New("key revoked")
+	}
+	if key.SelfSignature != nil && key.PublicKey.KeyExpired(key.SelfSignature, *s.Created) {
+		return errors.New("key expired")
+	}
+	return nil
+}
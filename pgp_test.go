@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// pgpEntity makes an Ed25519 key created at created.
+func pgpEntity(t *testing.T, name string, created time.Time, lifetime uint32) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.org", &packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		Time:            func() time.Time { return created },
+		KeyLifetimeSecs: lifetime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// pgpSign makes a detached signature over msg by e, created at created. It
+// builds the packet itself, as openpgp.DetachSign will not sign with a key
+// that is expired or revoked.
+func pgpSign(t *testing.T, e *openpgp.Entity, msg []byte, created time.Time, lifetime uint32) []byte {
+	t.Helper()
+	sig := &packet.Signature{
+		Version:      4,
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   e.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: created,
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+	if lifetime != 0 {
+		sig.SigLifetimeSecs = &lifetime
+	}
+	h, err := sig.PrepareSign(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(msg)
+	if err := sig.Sign(h, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := sig.Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestVerifyPGP(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	good := pgpEntity(t, "Release Signing", hourAgo, 0)
+	other := pgpEntity(t, "Someone Else", hourAgo, 0)
+	short := pgpEntity(t, "Short Lived", hourAgo, 60)
+	revoked := pgpEntity(t, "Revoked", hourAgo, 0)
+	if err := revoked.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte(sha256foo + "  foo\n")
+	var armored bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&armored, good, bytes.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var pub bytes.Buffer
+	if err := good.PrimaryKey.Serialize(&pub); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring openpgp.EntityList
+		msg     []byte
+		sig     []byte
+		err     string
+	}{
+		{"valid", openpgp.EntityList{good}, msg, pgpSign(t, good, msg, now, 0), ""},
+		{"armored", openpgp.EntityList{good}, msg, armored.Bytes(), ""},
+		{"no keyring", nil, msg, pgpSign(t, good, msg, now, 0), "no keyring configured"},
+		{"unknown key", openpgp.EntityList{good}, msg, pgpSign(t, other, msg, now, 0), "unknown key"},
+		{"changed message", openpgp.EntityList{good}, append([]byte("x"), msg...), pgpSign(t, good, msg, now, 0), "invalid signature"},
+		{"not a signature", openpgp.EntityList{good}, msg, pub.Bytes(), "not a signature"},
+		{"garbage", openpgp.EntityList{good}, msg, []byte("garbage"), "invalid data"},
+		{"signature expired", openpgp.EntityList{good}, msg, pgpSign(t, good, msg, hourAgo, 60), "signature expired"},
+		{"signed before the key expired", openpgp.EntityList{short}, msg, pgpSign(t, short, msg, hourAgo.Add(time.Second), 0), ""},
+		{"key expired", openpgp.EntityList{short}, msg, pgpSign(t, short, msg, now, 0), "key expired"},
+		{"key revoked", openpgp.EntityList{revoked}, msg, pgpSign(t, revoked, msg, now, 0), "revoked"},
+	}
+	saved := keyring
+	defer func() { keyring = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring = tt.keyring
+			s := verifyPGP(tt.msg, tt.sig)
+			if s.Valid != (tt.err == "") || !strings.Contains(s.Error, tt.err) {
+				t.Errorf("valid %v, error %q, want error %q", s.Valid, s.Error, tt.err)
+			}
+			if s.Valid && s.Signer == "" {
+				t.Error("no signer")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// errRedirectRefused is why we stop following redirects.
+var errRedirectRefused = errors.New("redirect refused")
+
+// RedirectPolicy is which redirects we follow.
+type RedirectPolicy struct {
+	MaxHops        int  // follow at most this many redirects
+	AllowDowngrade bool // follow https to http
+	SameSite       bool // stay on the registrable domain we started on
+}
+
+// Tighten returns the stricter of p and o.
+func (p RedirectPolicy) Tighten(o RedirectPolicy) RedirectPolicy {
+	if o.MaxHops < p.MaxHops {
+		p.MaxHops = o.MaxHops
+	}
+	p.AllowDowngrade = p.AllowDowngrade && o.AllowDowngrade
+	p.SameSite = p.SameSite || o.SameSite
+	return p
+}
+
+// requestRedirectPolicy reads the policy a client asked for, which can only
+// be stricter than server's.
+func requestRedirectPolicy(r *http.Request, server RedirectPolicy) (RedirectPolicy, error) {
+	p := RedirectPolicy{MaxHops: server.MaxHops, AllowDowngrade: true}
+	if v := r.FormValue("max_redirects"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return server, fmt.Errorf("bad max_redirects %q", v)
+		}
+		p.MaxHops = n
+	}
+	if v := r.FormValue("same_site"); v != "" {
+		same, err := strconv.ParseBool(v)
+		if err != nil {
+			return server, fmt.Errorf("bad same_site %q", v)
+		}
+		p.SameSite = same
+	}
+	return server.Tighten(p), nil
+}
+
+// Hop is one redirect we followed: url answered with status.
+type Hop struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+// redirects is the policy for one fetch and the hops it took.
+type redirects struct {
+	policy RedirectPolicy
+	hops   []Hop
+}
+
+type redirectsKey struct{}
+
+// trackRedirects returns a context under which fetches follow redirects by
+// policy and record each hop in the returned redirects.
+func trackRedirects(ctx context.Context, policy RedirectPolicy) (context.Context, *redirects) {
+	rd := &redirects{policy: policy}
+	return context.WithValue(ctx, redirectsKey{}, rd), rd
+}
+
+// Hops returns the redirects followed, or nil if there were none.
+func (rd *redirects) Hops() []Hop {
+	if rd == nil {
+		return nil
+	}
+	return rd.hops
+}
+
+// site is the registrable domain of host, or host itself for addresses
+// and names the public suffix list does not cover.
+func site(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if s, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return s
+	}
+	return host
+}
+
+// Keep useragent on redirect, and only follow redirects the policy allows,
+// recording each one.
+func redirectPolicyFunc(req *http.Request, reqs []*http.Request) error {
+	req.Header.Set("User-Agent", "checksigd/0.1")
+
+	rd, _ := req.Context().Value(redirectsKey{}).(*redirects)
+	if rd == nil {
+		rd = &redirects{policy: serverRedirectPolicy()}
+	}
+	prev := reqs[len(reqs)-1]
+	status := 0
+	if req.Response != nil {
+		status = req.Response.StatusCode
+	}
+	rd.hops = append(rd.hops, Hop{prev.URL.String(), status})
+
+	return rd.policy.check(reqs[0].URL, prev.URL, req.URL, len(reqs))
+}
+
+// check refuses the n'th redirect, from prev to next, of a fetch that
+// started at first, if the policy does not allow it.
+func (p RedirectPolicy) check(first, prev, next *url.URL, n int) error {
+	switch {
+	case n > p.MaxHops:
+		return fmt.Errorf("%w: more than %d redirects", errRedirectRefused, p.MaxHops)
+	case !p.AllowDowngrade && prev.Scheme == "https" && next.Scheme != "https":
+		return fmt.Errorf("%w: https downgraded to %s at %s", errRedirectRefused, next.Scheme, next)
+	case p.SameSite && site(first.Hostname()) != site(next.Hostname()):
+		return fmt.Errorf("%w: %s is not on %s", errRedirectRefused, next.Hostname(), site(first.Hostname()))
+	}
+	return nil
+}
+
+// allows reports whether the policy would have followed hops, which ended
+// at final.
+func (p RedirectPolicy) allows(hops []Hop, final string) bool {
+	var urls []*url.URL
+	for _, h := range hops {
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return false
+		}
+		urls = append(urls, u)
+	}
+	last, err := url.Parse(final)
+	if err != nil {
+		return false
+	}
+	urls = append(urls, last)
+	for i := 1; i < len(urls); i++ {
+		if p.check(urls[0], urls[i-1], urls[i], i) != nil {
+			return false
+		}
+	}
+	return true
+}
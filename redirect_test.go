@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestRedirectPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RedirectPolicy
+		first  string
+		prev   string
+		next   string
+		n      int
+		ok     bool
+	}{
+		{"within hops", RedirectPolicy{MaxHops: 2}, "https://a.org/x", "https://a.org/x", "https://b.org/y", 2, true},
+		{"too many hops", RedirectPolicy{MaxHops: 2}, "https://a.org/x", "https://b.org/y", "https://c.org/z", 3, false},
+		{"no redirects", RedirectPolicy{MaxHops: 0}, "https://a.org/x", "https://a.org/x", "https://a.org/y", 1, false},
+		{"downgrade", RedirectPolicy{MaxHops: 5}, "https://a.org/x", "https://a.org/x", "http://a.org/x", 1, false},
+		{"downgrade allowed", RedirectPolicy{MaxHops: 5, AllowDowngrade: true}, "https://a.org/x", "https://a.org/x", "http://a.org/x", 1, true},
+		{"upgrade", RedirectPolicy{MaxHops: 5}, "http://a.org/x", "http://a.org/x", "https://a.org/x", 1, true},
+		{"same site", RedirectPolicy{MaxHops: 5, SameSite: true}, "https://dl.a.org/x", "https://dl.a.org/x", "https://mirror.a.org/x", 1, true},
+		{"other site", RedirectPolicy{MaxHops: 5, SameSite: true}, "https://dl.a.org/x", "https://dl.a.org/x", "https://a.org.evil.com/x", 1, false},
+		{"other site later", RedirectPolicy{MaxHops: 5, SameSite: true}, "https://a.org/x", "https://www.a.org/x", "https://b.org/x", 2, false},
+		{"public suffix", RedirectPolicy{MaxHops: 5, SameSite: true}, "https://foo.github.io/x", "https://foo.github.io/x", "https://bar.github.io/x", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, _ := url.Parse(tt.first)
+			prev, _ := url.Parse(tt.prev)
+			next, _ := url.Parse(tt.next)
+			err := tt.policy.check(first, prev, next, tt.n)
+			if (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, errRedirectRefused) {
+				t.Errorf("error %v is not errRedirectRefused", err)
+			}
+		})
+	}
+}
+
+func TestRedirectPolicyAllows(t *testing.T) {
+	hops := []Hop{{"https://a.org/x", 302}, {"https://www.a.org/x", 301}}
+	tests := []struct {
+		name   string
+		policy RedirectPolicy
+		final  string
+		ok     bool
+	}{
+		{"followed", RedirectPolicy{MaxHops: 2}, "https://cdn.b.org/x", true},
+		{"too many", RedirectPolicy{MaxHops: 1}, "https://cdn.b.org/x", false},
+		{"other site", RedirectPolicy{MaxHops: 2, SameSite: true}, "https://cdn.b.org/x", false},
+		{"downgraded", RedirectPolicy{MaxHops: 2}, "http://www.a.org/x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(hops, tt.final); got != tt.ok {
+				t.Errorf("allows = %v", got)
+			}
+		})
+	}
+}
+
+func TestRedirectPolicyTighten(t *testing.T) {
+	server := RedirectPolicy{MaxHops: 5, AllowDowngrade: false, SameSite: false}
+	got := server.Tighten(RedirectPolicy{MaxHops: 10, AllowDowngrade: true, SameSite: true})
+	if want := (RedirectPolicy{MaxHops: 5, AllowDowngrade: false, SameSite: true}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// HashRequest is what a client asks us to check.
+type HashRequest struct {
+	URL         *url.URL       // checksum file
+	Sig         *url.URL       // detached signature over it
+	Artifact    *url.URL       // file to verify against it
+	ArtifactSig *url.URL       // minisign signature over the artifact
+	Hashes      []string       // extra algorithms to compute over the artifact
+	File        string         // glob of the filenames to return entries for
+	Redirects   RedirectPolicy // which redirects to follow
+	Limits      Limits         // how much to read
+	NoCache     bool           // ask upstream even if our copy is fresh
+	Attest      bool           // sign what we say
+	NoPeers     bool           // do not ask peers, as peers ask us
+	Quorum      int            // authenticated peers that must agree
+	Nonce       string         // to put in the attestation
+	HTML        bool           // read digests out of an HTML page
+
+	Deadlines         Deadlines
+	ArtifactDeadlines Deadlines
+}
+
+// HashResponse is what HashHandler returns, as JSON.
+type HashResponse struct {
+	URL       string       `json:"url"`
+	FinalURL  string       `json:"final_url"`
+	Redirects []Hop        `json:"redirects,omitempty"`
+	Entries   []Entry      `json:"entries"`
+	Errors    []*LineError `json:"errors,omitempty"`
+	Bytes     int64        `json:"bytes"`
+	SHA256    string       `json:"sha256"` // of the checksum file as we read it
+	Truncated bool         `json:"truncated,omitempty"`
+	Coalesced bool         `json:"coalesced,omitempty"` // fetched once for several requests
+
+	Signature    *Signature    `json:"signature,omitempty"`
+	Verification *Verification `json:"verification,omitempty"`
+	Discovery    *Discovery    `json:"discovery,omitempty"`
+	Cache        *CacheInfo    `json:"cache,omitempty"`
+	History      *HistoryInfo  `json:"history,omitempty"`
+	Peers        *Consensus    `json:"peers,omitempty"`
+	Attestation  *Envelope     `json:"attestation,omitempty"`
+}
+
+// HashRequester fetches, parses and verifies what HashRequests ask for.
+type HashRequester struct {
+	flights flightGroup // checksum files being fetched
+}
+
+// requester serves HashHandler.
+var requester = &HashRequester{}
+
+// parseURL reads the URL in form field name, which must be http or https
+// and no longer than max. Optional fields may be empty, giving nil.
+func parseURL(r *http.Request, name string, required bool, max int) (*url.URL, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		if required {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadURL, name+" is required")
+		}
+		return nil, nil
+	}
+	if len(v) > max {
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, CodeURLTooLong,
+			fmt.Sprintf("%s is %d chars, we take %d", name, len(v), max))
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadURL, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadURL, name+" must be an http or https URL")
+	}
+	return u, nil
+}
+
+// parseHashRequest reads a HashRequest from the form values of r, within
+// limits.
+func parseHashRequest(r *http.Request, limits Limits) (*HashRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	req := &HashRequest{Hashes: parseAlgorithms(r.FormValue("hashes")), Limits: limits}
+	var err error
+	if req.Artifact, err = parseURL(r, "artifact", false, req.Limits.URL); err != nil {
+		return nil, err
+	}
+	// Without a checksum file, we look for one next to the artifact
+	if req.URL, err = parseURL(r, "url", req.Artifact == nil, req.Limits.URL); err != nil {
+		return nil, err
+	}
+	if req.Sig, err = parseURL(r, "sig", false, req.Limits.URL); err != nil {
+		return nil, err
+	}
+	if req.File = r.FormValue("file"); req.File != "" {
+		if _, err := path.Match(req.File, ""); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad file pattern %q", req.File))
+		}
+	}
+	if req.Artifact != nil {
+		if req.ArtifactSig, err = parseURL(r, "artifactsig", false, req.Limits.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := r.FormValue("nocache"); v != "" {
+		if req.NoCache, err = strconv.ParseBool(v); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad nocache %q", v))
+		}
+	}
+	if v := r.FormValue("nopeers"); v != "" {
+		if req.NoPeers, err = strconv.ParseBool(v); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad nopeers %q", v))
+		}
+	}
+	req.Quorum, req.Nonce = *quorum, r.FormValue("nonce")
+	if v := r.FormValue("quorum"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad quorum %q", v))
+		}
+		// Clients can only ask for more
+		if n > req.Quorum {
+			req.Quorum = n
+		}
+	}
+	if v := r.FormValue("html"); v != "" {
+		if req.HTML, err = strconv.ParseBool(v); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad html %q", v))
+		}
+	}
+	if v := r.FormValue("attest"); v != "" {
+		if req.Attest, err = strconv.ParseBool(v); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad attest %q", v))
+		}
+	}
+
+	// Redirect policy and deadlines, which the request may tighten
+	if req.Redirects, err = requestRedirectPolicy(r, serverRedirectPolicy()); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	req.Deadlines, req.ArtifactDeadlines = serverDeadlines()
+	if req.Deadlines, err = requestDeadlines(r, "", req.Deadlines); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	if req.ArtifactDeadlines, err = requestDeadlines(r, "artifact_", req.ArtifactDeadlines); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	return req, nil
+}
+
+// Do fetches and parses the checksum file, discovering it next to the
+// artifact if need be, then checks whatever signatures
+// and artifact req names. Failing to get a usable checksum file is an error;
+// a bad signature or artifact is reported in the response.
+func (h *HashRequester) Do(ctx context.Context, req *HashRequest) (*HashResponse, error) {
+	// Find the checksum file if we were only given the artifact, fetching
+	// and parsing it as we do; otherwise fetch and parse it while we see
+	// what our peers see of it
+	var (
+		discovery *Discovery
+		peersaw   <-chan []PeerResult
+		cf        *checksumFile
+		coalesced bool
+		err       error
+	)
+	if req.URL == nil {
+		log.Println("Discovering", req.Artifact)
+		discovery = discover(ctx, req)
+		if cf, coalesced, err = h.discovered(ctx, req, discovery); err != nil {
+			return nil, err
+		}
+		peersaw = h.askPeers(ctx, req)
+	} else {
+		peersaw = h.askPeers(ctx, req)
+		if cf, coalesced, err = h.checksums(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	if coalesced {
+		log.Println("Shared fetch of", req.URL)
+	}
+
+	// Only the entries asked for, if any
+	listed := cf.Entries
+	if req.File != "" {
+		if listed, err = FilterEntries(cf.Entries, req.File); errors.Is(err, errFileNotListed) {
+			return nil, newAPIError(http.StatusNotFound, CodeFileNotListed, err.Error())
+		} else if err != nil {
+			return nil, newAPIError(http.StatusBadGateway, CodeConflictingEntries, err.Error())
+		}
+	}
+	response := &HashResponse{
+		URL:       req.URL.String(),
+		FinalURL:  cf.FinalURL,
+		Redirects: cf.Redirects,
+		Entries:   listed,
+		Errors:    cf.Errors,
+		Bytes:     cf.Bytes,
+		SHA256:    cf.Digest,
+		Truncated: cf.Truncated,
+		Coalesced: coalesced,
+		Signature: cf.Signature,
+		Discovery: discovery,
+		Cache:     cf.Cache,
+		History:   cf.History,
+	}
+
+	// Check the signature over the checksum file, if there is one
+	if req.Sig != nil {
+		log.Println("Grabbing signature", req.Sig)
+		sigctx, _ := trackRedirects(ctx, req.Redirects)
+		sig, err := fetch(sigctx, req.Sig, req.Limits.Sig, req.Deadlines, req.NoCache)
+		if err != nil {
+			response.Signature = &Signature{Error: err.Error()}
+		} else if cf.Truncated {
+			response.Signature = &Signature{Error: errTruncated(req.Limits.Body).Error()}
+		} else {
+			response.Signature = verifySignature(cf.Body, sig, req.URL.Hostname())
+		}
+		response.Signature.URL = req.Sig.String()
+		log.Println("Signature valid:", response.Signature.Valid)
+	}
+
+	// Fetch and hash the artifact, if asked to
+	if req.Artifact != nil {
+		log.Println("Verifying", req.Artifact)
+		var minisig []byte
+		var sigerr error
+		if req.ArtifactSig != nil {
+			log.Println("Grabbing artifact signature", req.ArtifactSig)
+			sigctx, _ := trackRedirects(ctx, req.Redirects)
+			minisig, sigerr = fetch(sigctx, req.ArtifactSig, req.Limits.Sig, req.Deadlines, req.NoCache)
+		}
+		response.Verification = verifyArtifact(ctx, req.ArtifactDeadlines, req.Redirects, req.Artifact, cf.Entries, req.Hashes, minisig, sigerr)
+		if response.Verification.Signature != nil {
+			response.Verification.Signature.URL = req.ArtifactSig.String()
+		}
+		log.Println("Match:", response.Verification.Match)
+	}
+
+	if peersaw != nil {
+		response.Peers = consensus(cf.Digest, cf.Truncated, <-peersaw, req.Quorum)
+		log.Println("Peers:", response.Peers.Verdict)
+	}
+
+	// Sign what we said, for the client to show later
+	if req.Attest {
+		if response.Attestation, err = attest(response, cf, req.Nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// askPeers asks our peers what they see of req, unless req is not to.
+func (h *HashRequester) askPeers(ctx context.Context, req *HashRequest) <-chan []PeerResult {
+	if len(peers) == 0 || req.NoPeers {
+		return nil
+	}
+	log.Println("Asking peers")
+	return askPeers(ctx, req)
+}
+
+// checksums fetches and parses the checksum file, along with anyone else
+// asking for it right now, though no longer than we were asked to wait.
+func (h *HashRequester) checksums(ctx context.Context, req *HashRequest) (*checksumFile, bool, error) {
+	log.Println("Grabbing", req.URL)
+	wait, cancel := ctx, context.CancelFunc(func() {})
+	if req.Deadlines.Total > 0 {
+		wait, cancel = context.WithTimeoutCause(ctx, req.Deadlines.Total, errTotalTimeout)
+	}
+	defer cancel()
+	cf, coalesced, err := h.flights.Do(wait, flightKey(req), func(ctx context.Context) (*checksumFile, error) {
+		shared := *req
+		shared.Deadlines, _ = serverDeadlines()
+		return h.fetchChecksums(ctx, &shared)
+	})
+	if err != nil {
+		var e *APIError
+		if !errors.As(err, &e) {
+			err = upstreamError(err)
+		}
+		return nil, false, err
+	}
+	return cf, coalesced, nil
+}
+
+// discovered fetches the checksum files d found in turn, and uses the first
+// that lists the artifact, filling in req.URL, and req.Sig if there is a
+// signature over it.
+func (h *HashRequester) discovered(ctx context.Context, req *HashRequest, d *Discovery) (*checksumFile, bool, error) {
+	name := path.Base(req.Artifact.Path)
+	for _, f := range d.Found {
+		if f.Kind != "checksums" {
+			continue
+		}
+		req.URL, _ = url.Parse(f.URL)
+		cf, coalesced, err := h.checksums(ctx, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, err
+			}
+			log.Println("Discovered", f.URL, err)
+			continue
+		}
+		if len(selectEntries(cf.Entries, name)) == 0 {
+			log.Println("Discovered", f.URL, "does not list", name)
+			continue
+		}
+		d.use(req, f.URL)
+		return cf, coalesced, nil
+	}
+	req.URL = nil
+	return nil, false, newAPIError(http.StatusNotFound, CodeNothingDiscovered,
+		"no checksum file listing "+name+" found next to "+req.Artifact.String())
+}
+
+// checksumFile is a fetched and parsed checksum file, which requests for
+// it at the same time share. It must not change once made.
+type checksumFile struct {
+	FinalURL  string
+	Redirects []Hop
+	Entries   []Entry
+	Errors    []*LineError
+	Body      []byte // what was signed, if there is a signature to check
+	Bytes     int64
+	Truncated bool
+	Digest    string     // SHA256 of what we read
+	Fetched   time.Time  // when upstream last gave it to us
+	Signature *Signature // embedded in the file
+	Cache     *CacheInfo
+	History   *HistoryInfo
+}
+
+// fetchChecksums fetches and parses the checksum file req names.
+func (h *HashRequester) fetchChecksums(ctx context.Context, req *HashRequest) (*checksumFile, error) {
+	// Send request to alien server
+	getctx, rd := trackRedirects(ctx, req.Redirects)
+	getctx, addr := withRemoteAddr(getctx)
+	resp, cacheinfo, err := cache.Get(getctx, req.URL, req.Deadlines, req.Limits.Body, req.NoCache)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(http.StatusBadGateway, CodeUpstreamStatus, "upstream: "+resp.Status)
+	}
+
+	// Peek at the start: an HTML page may have digests published in it, if
+	// the client asked us to look, unless it is a captive portal's.
+	// Anything else has to be an allowed type and look like text, and may
+	// carry its own signature.
+	br := bufio.NewReaderSize(resp.Body, 4096)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, upstreamError(err)
+	}
+	ct := resp.Header.Get("content-type")
+	page := req.HTML && *extracthtml && (isHTMLType(ct) || looksLikeHTML(head))
+	if page && looksLikePortal(head) {
+		return nil, newAPIError(http.StatusBadGateway, CodeNotChecksumFile, errNotChecksumFile.Error()+": looks like a captive portal page")
+	}
+	if !page {
+		if err := allowedContentType(ct); err != nil {
+			return nil, newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedContent, err.Error())
+		}
+		if err := sniff(head); err != nil {
+			return nil, newAPIError(http.StatusBadGateway, CodeNotChecksumFile, err.Error())
+		}
+	}
+	log.Println("Looks good!")
+
+	// Read whole lines up to our limit. A checksum file with a signature
+	// is kept to check it, others are parsed as they come in.
+	lr := newLineLimitReader(br, req.Limits.Body)
+	digest := sha256.New()
+	src := io.TeeReader(lr, digest)
+	var (
+		body      []byte
+		truncated bool
+		embedded  *Signature
+		entries   []Entry
+		lineerrs  []*LineError
+	)
+	if page {
+		// Pages need not come in lines
+		if body, err = ioutil.ReadAll(io.LimitReader(br, req.Limits.Body+1)); err != nil {
+			return nil, upstreamError(err)
+		}
+		if truncated = int64(len(body)) > req.Limits.Body; truncated {
+			body = body[:req.Limits.Body]
+		}
+		digest.Write(body)
+		if entries = ExtractChecksums(bytes.NewReader(body), req.URL.Path); len(entries) == 0 {
+			return nil, newAPIError(http.StatusBadGateway, CodeNotChecksumFile, errNotChecksumFile.Error()+": no digests found in HTML page")
+		}
+		log.Printf("Extracted %d entries from page %s", len(entries), req.URL)
+	} else if bytes.HasPrefix(head, []byte("untrusted comment:")) || isClearsigned(head) {
+		if body, err = ioutil.ReadAll(src); err != nil {
+			return nil, upstreamError(err)
+		}
+
+		// An embedded signify signature carries the checksum file after
+		// it, a clearsigned one carries it inside
+		if msg, ok := signifyEmbedded(body); ok {
+			embedded = verifySignify(msg, body)
+			body = msg
+		} else if isClearsigned(body) {
+			body, embedded = verifyClearsigned(body)
+		}
+		if embedded != nil {
+			embedded.URL = req.URL.String()
+		}
+		entries, lineerrs, err = ParseChecksums(bytes.NewReader(body), req.URL.Path)
+	} else if req.Sig != nil {
+		var buf bytes.Buffer
+		entries, lineerrs, err = ParseChecksums(io.TeeReader(src, &buf), req.URL.Path)
+		body = buf.Bytes()
+	} else {
+		entries, lineerrs, err = ParseChecksums(src, req.URL.Path)
+	}
+	if err == bufio.ErrTooLong || err == errLateClearsign {
+		return nil, newAPIError(http.StatusBadGateway, CodeBadChecksumFile, err.Error())
+	} else if err != nil {
+		return nil, upstreamError(err)
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	cf := &checksumFile{
+		FinalURL:  resp.Request.URL.String(),
+		Redirects: rd.Hops(),
+		Entries:   entries,
+		Errors:    lineerrs,
+		Body:      body,
+		Bytes:     lr.N(),
+		Truncated: lr.Truncated,
+		Signature: embedded,
+		Cache:     cacheinfo,
+	}
+	if page {
+		cf.Bytes, cf.Truncated = int64(len(body)), truncated
+	}
+
+	// What we have seen of it before. What the cache served we have.
+	sum := hex.EncodeToString(digest.Sum(nil))
+	cf.Digest, cf.Fetched = sum, time.Now().UTC()
+	if cacheinfo != nil {
+		cf.Fetched = cacheinfo.Validated.UTC()
+	}
+	if cacheinfo == nil || !cacheinfo.Hit {
+		cf.History = history.Observe(observation(cacheKey(req.URL), resp, sum, cf.Bytes, cf.Truncated, addr.String()))
+	} else if cf.Truncated {
+		cf.History = history.Info(cacheKey(req.URL), "")
+	} else {
+		cf.History = history.Info(cacheKey(req.URL), sum)
+	}
+
+	if cf.Truncated {
+		log.Printf("Truncated %s at %d bytes", req.URL, cf.Bytes)
+		if embedded != nil {
+			embedded.Valid = false
+			embedded.Error = errTruncated(req.Limits.Body).Error()
+		}
+	}
+	return cf, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+// Signature is the result of checking a signature over a checksum file or
+// an artifact.
+type Signature struct {
+	URL         string     `json:"url,omitempty"`
+	Scheme      string     `json:"scheme,omitempty"`
+	KeyID       string     `json:"key_id,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Signer      string     `json:"signer,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+
+	TrustedComment string `json:"trusted_comment,omitempty"`
+
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// signatureScheme tells what kind of signature sig is.
+func signatureScheme(sig []byte) string {
+	if isMinisign(sig) {
+		return "minisign"
+	}
+	if isSignify(sig) {
+		return "signify"
+	}
+	return "pgp"
+}
+
+// verifySignature checks the detached signature sig over signed, which was
+// fetched from host, with whichever scheme made it.
+func verifySignature(signed, sig []byte, host string) *Signature {
+	switch signatureScheme(sig) {
+	case "minisign":
+		return verifyMinisign(signed, sig, host)
+	case "signify":
+		return verifySignify(signed, sig)
+	default:
+		return verifyPGP(signed, sig)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// signify keys and signatures are a comment line, then a base64 line holding
+// the algorithm, an 8 byte key number and the key or signature itself.
+const (
+	signifyComment = "untrusted comment: "
+	signifyAlg     = "Ed"
+	signifyKeyNum  = 8
+)
+
+// signifyKey is a trusted signify public key.
+type signifyKey struct {
+	comment string
+	key     ed25519.PublicKey
+}
+
+// signifyKeys are the keys we trust, by key number, loaded from the
+// -signify flag.
+var signifyKeys = map[[signifyKeyNum]byte]signifyKey{}
+
+// isSignify reports whether b looks like signify framing.
+func isSignify(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(signifyComment))
+}
+
+// readSignify splits b into its untrusted comment, the decoded base64 blob
+// and whatever follows, which for an embedded signature is the message.
+func readSignify(b []byte, size int) (comment string, blob, rest []byte, err error) {
+	if !isSignify(b) {
+		return "", nil, nil, errors.New("missing untrusted comment")
+	}
+	lines := bytes.SplitN(b, []byte("\n"), 3)
+	if len(lines) < 2 {
+		return "", nil, nil, errors.New("truncated signify file")
+	}
+	comment = strings.TrimPrefix(string(lines[0]), signifyComment)
+	blob, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(lines[1])))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if len(blob) != len(signifyAlg)+signifyKeyNum+size || string(blob[:2]) != signifyAlg {
+		return "", nil, nil, errors.New("unsupported signify format")
+	}
+	if len(lines) == 3 {
+		rest = lines[2]
+	}
+	return comment, blob[2:], rest, nil
+}
+
+// loadSignifyKeys reads a comma separated list of signify public key files.
+func loadSignifyKeys(files string) error {
+	for _, file := range strings.Split(files, ",") {
+		b, err := os.ReadFile(strings.TrimSpace(file))
+		if err != nil {
+			return err
+		}
+		comment, blob, _, err := readSignify(b, ed25519.PublicKeySize)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		var num [signifyKeyNum]byte
+		copy(num[:], blob)
+		signifyKeys[num] = signifyKey{comment, ed25519.PublicKey(blob[signifyKeyNum:])}
+	}
+	return nil
+}
+
+// signifyEmbedded returns the message carried by an embedded signify
+// signature (signify -S -e), as OpenBSD publishes SHA256.sig.
+func signifyEmbedded(b []byte) ([]byte, bool) {
+	_, _, msg, err := readSignify(b, ed25519.SignatureSize)
+	if err != nil || len(msg) == 0 {
+		return nil, false
+	}
+	return msg, true
+}
+
+// verifySignify checks the signify signature sig over msg against our
+// trusted keys.
+func verifySignify(msg, sig []byte) *Signature {
+	s := &Signature{Scheme: "signify"}
+	_, blob, _, err := readSignify(sig, ed25519.SignatureSize)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	var num [signifyKeyNum]byte
+	copy(num[:], blob)
+	s.KeyID = fmt.Sprintf("%X", num)
+
+	key, ok := signifyKeys[num]
+	if !ok {
+		s.Error = "unknown key " + s.KeyID
+		return s
+	}
+	s.Signer = key.comment
+	s.Fingerprint = base64.StdEncoding.EncodeToString(key.key)
+
+	if !ed25519.Verify(key.key, msg, blob[signifyKeyNum:]) {
+		s.Error = "signature verification failed"
+		return s
+	}
+	s.Valid = true
+	return s
+}
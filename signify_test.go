@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// signifySig frames an Ed25519 signature over msg by key number num as
+// signify writes it.
+func signifySig(priv ed25519.PrivateKey, num [signifyKeyNum]byte, msg []byte) []byte {
+	blob := append(append([]byte(signifyAlg), num[:]...), ed25519.Sign(priv, msg)...)
+	return []byte(signifyComment + "verify with test.pub\n" + base64.StdEncoding.EncodeToString(blob) + "\n")
+}
+
+func TestVerifySignify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	num := [signifyKeyNum]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	unknown := [signifyKeyNum]byte{8, 7, 6, 5, 4, 3, 2, 1}
+
+	saved := signifyKeys
+	signifyKeys = map[[signifyKeyNum]byte]signifyKey{num: {"test key", pub}}
+	defer func() { signifyKeys = saved }()
+
+	msg := []byte(sha256foo + "  foo\n")
+	tests := []struct {
+		name string
+		msg  []byte
+		sig  []byte
+		err  string
+	}{
+		{"valid", msg, signifySig(priv, num, msg), ""},
+		{"unknown key", msg, signifySig(priv, unknown, msg), "unknown key 0807060504030201"},
+		{"wrong key", msg, signifySig(other, num, msg), "signature verification failed"},
+		{"changed message", append([]byte("x"), msg...), signifySig(priv, num, msg), "signature verification failed"},
+		{"no comment", msg, bytes.TrimPrefix(signifySig(priv, num, msg), []byte("untrusted ")), "missing untrusted comment"},
+		{"short blob", msg, []byte(signifyComment + "x\n" + base64.StdEncoding.EncodeToString([]byte("Ed12345678")) + "\n"), "unsupported signify format"},
+		{"not base64", msg, []byte(signifyComment + "x\n!!!\n"), "illegal base64 data at input byte 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := verifySignify(tt.msg, tt.sig)
+			if s.Valid != (tt.err == "") || s.Error != tt.err {
+				t.Errorf("valid %v, error %q, want error %q", s.Valid, s.Error, tt.err)
+			}
+			if s.Valid && s.Signer != "test key" {
+				t.Errorf("signer %q", s.Signer)
+			}
+		})
+	}
+}
+
+func TestSignifyEmbedded(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	msg := "SHA256 (foo) = " + sha256foo + "\n"
+	sig := signifySig(priv, [signifyKeyNum]byte{}, []byte(msg))
+
+	tests := []struct {
+		name string
+		in   string
+		msg  string
+		ok   bool
+	}{
+		{"embedded", string(sig) + msg, msg, true},
+		{"detached", string(sig), "", false},
+		{"not signify", msg, "", false},
+		{"truncated", strings.SplitN(string(sig), "\n", 2)[0], "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := signifyEmbedded([]byte(tt.in))
+			if ok != tt.ok || string(got) != tt.msg {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.msg, tt.ok)
+			}
+		})
+	}
+}
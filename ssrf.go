@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// errForbiddenAddress is why we refuse to connect somewhere.
+var errForbiddenAddress = errors.New("forbidden address")
+
+// deniedNets are networks we never fetch from, beyond what net.IP already
+// knows to be loopback, private, link-local, multicast or unspecified.
+var deniedNets = mustCIDRs(
+	"0.0.0.0/8",          // this network
+	"100.64.0.0/10",      // carrier-grade NAT
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.0.2.0/24",       // documentation
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // documentation
+	"203.0.113.0/24",     // documentation
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"64:ff9b::/96",       // NAT64, reaches IPv4 space we deny
+	"64:ff9b:1::/48",     // local-use NAT64
+	"100::/64",           // discard
+	"2001:db8::/32",      // documentation
+	"2002::/16",          // 6to4, reaches IPv4 space we deny
+)
+
+// allowedNets are exceptions to the above, given with -allow.
+var allowedNets []*net.IPNet
+
+func mustCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// parseCIDRs reads a comma separated list of networks.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden reports whether ip is somewhere a stranger should not be able to
+// make us connect to.
+func forbidden(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if inNets(ip, allowedNets) {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		inNets(ip, deniedNets)
+}
+
+// safeDialer connects only to addresses that are not forbidden. It resolves
+// the host once, checks every address, and dials the checked address itself,
+// so a DNS answer that changes in between (rebinding) gets nowhere. The
+// transport dials through it for every request, redirects included.
+type safeDialer struct {
+	dialer   *net.Dialer
+	resolver *net.Resolver
+}
+
+func (d *safeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// One bad address is enough to refuse the host, whichever we would
+	// have tried first.
+	for _, ip := range ips {
+		if forbidden(ip.IP) {
+			return nil, fmt.Errorf("%w: %s is %s", errForbiddenAddress, host, ip.IP)
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%s: no addresses", host)
+	}
+	return nil, err
+}
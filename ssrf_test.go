@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestForbidden(t *testing.T) {
+	tests := []struct {
+		ip        string
+		forbidden bool
+	}{
+		{"93.184.215.14", false},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true}, // cloud metadata
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true}, // IPv4-mapped
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true}, // NAT64 of 10.0.0.1
+		{"2002:a00:1::", true},   // 6to4 of 10.0.0.1
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := forbidden(net.ParseIP(tt.ip)); got != tt.forbidden {
+				t.Errorf("forbidden(%s) = %v", tt.ip, got)
+			}
+		})
+	}
+}
+
+func TestForbiddenAllowed(t *testing.T) {
+	saved := allowedNets
+	defer func() { allowedNets = saved }()
+	allowedNets = mustCIDRs("10.1.0.0/16")
+	for ip, want := range map[string]bool{"10.1.2.3": false, "::ffff:10.1.2.3": false, "10.2.0.1": true} {
+		if got := forbidden(net.ParseIP(ip)); got != want {
+			t.Errorf("forbidden(%s) = %v with 10.1.0.0/16 allowed", ip, got)
+		}
+	}
+}
+
+func TestSafeDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	d := &safeDialer{&net.Dialer{Timeout: time.Second}, net.DefaultResolver}
+
+	saved := allowedNets
+	defer func() { allowedNets = saved }()
+	tests := []struct {
+		name    string
+		addr    string
+		allowed string
+		err     error
+	}{
+		{"loopback", u.Host, "", errForbiddenAddress},
+		{"loopback by name", net.JoinHostPort("localhost", u.Port()), "", errForbiddenAddress},
+		{"allowed", u.Host, "127.0.0.0/8", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedNets = mustCIDRs(tt.allowed)
+			conn, err := d.DialContext(context.Background(), "tcp", tt.addr)
+			if conn != nil {
+				conn.Close()
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
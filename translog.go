@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxLogEntries is the most entries /log/entries returns at once.
+const maxLogEntries = 1000
+
+// TreeHead is the size and hash of the log at a time, signed by us.
+type TreeHead struct {
+	TreeSize  int64  `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"` // ms since the epoch
+	RootHash  []byte `json:"sha256_root_hash"`
+	Signature []byte `json:"tree_head_signature"`
+}
+
+// signed is what the signature is over: the TreeHeadSignature of RFC 6962,
+// section 3.5, version 1 and signature type tree_hash.
+func (th *TreeHead) signed() []byte {
+	b := make([]byte, 2, 2+8+8+sha256.Size)
+	b[0], b[1] = 0, 1
+	b = binary.BigEndian.AppendUint64(b, uint64(th.Timestamp))
+	b = binary.BigEndian.AppendUint64(b, uint64(th.TreeSize))
+	return append(b, th.RootHash...)
+}
+
+// snapshot is the log as it is now. The leaves never change once there,
+// so the caller may use them without the lock.
+func (h *History) snapshot() (tree *merkleTree, offsets []int64, size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.offsets)
+	return h.tree.snapshot(), h.offsets[:n:n], h.size
+}
+
+// leafIndex is where the leaf with hash first is in the log, or -1.
+func (h *History) leafIndex(hash [sha256.Size]byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, ok := h.byHash[hash]; ok {
+		return i
+	}
+	return -1
+}
+
+// TreeHead signs the log as it is now.
+func (h *History) TreeHead() *TreeHead {
+	tree, _, _ := h.snapshot()
+	root := tree.root(tree.size())
+	th := &TreeHead{TreeSize: int64(tree.size()), Timestamp: time.Now().UnixMilli(), RootHash: root[:]}
+	th.Signature = ed25519.Sign(nodeKey, th.signed())
+	return th
+}
+
+// logRequest checks there is a log to ask about, and returns it.
+func logRequest(r *http.Request) (*History, error) {
+	if history == nil {
+		return nil, newAPIError(http.StatusNotFound, CodeNoLog, "this server keeps no log; start it with -history")
+	}
+	return history, r.ParseForm()
+}
+
+// formInt reads the whole number in form value name, def if there is none.
+func formInt(r *http.Request, name string, def int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad %s %q", name, v))
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func hashes(hs [][sha256.Size]byte) [][]byte {
+	out := make([][]byte, len(hs))
+	for i := range hs {
+		out[i] = hs[i][:]
+	}
+	return out
+}
+
+// LogHeadHandler returns a signed head of the log.
+func LogHeadHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := logRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, h.TreeHead())
+}
+
+// LogProofHandler proves the leaf at index, or with the base64 leaf hash,
+// is in the tree of tree_size leaves, the whole log if not given.
+func LogProofHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := logRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tree, _, _ := h.snapshot()
+	size, err := formInt(r, "tree_size", tree.size())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if size > tree.size() {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("tree_size %d, the log has %d", size, tree.size())))
+		return
+	}
+
+	index, err := formInt(r, "index", -1)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if v := r.FormValue("hash"); v != "" {
+		hash, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(hash) != sha256.Size {
+			writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("bad hash %q", v)))
+			return
+		}
+		if index = h.leafIndex([sha256.Size]byte(hash)); index >= size {
+			index = -1
+		}
+		if index < 0 {
+			writeError(w, r, newAPIError(http.StatusNotFound, CodeNotInLog, fmt.Sprintf("no leaf %s in the first %d", v, size)))
+			return
+		}
+	}
+	if index < 0 || index >= size {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("need an index below %d, or a hash", size)))
+		return
+	}
+
+	path, err := tree.inclusionProof(index, size)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"leaf_index": index,
+		"tree_size":  size,
+		"audit_path": hashes(path),
+	})
+}
+
+// LogConsistencyHandler proves the tree of second leaves grew from the tree
+// of first leaves.
+func LogConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := logRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tree, _, _ := h.snapshot()
+	first, err := formInt(r, "first", 0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	second, err := formInt(r, "second", tree.size())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if first < 1 || first > second || second > tree.size() {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest,
+			fmt.Sprintf("need 0 < first <= second <= %d, have %d and %d", tree.size(), first, second)))
+		return
+	}
+	proof, err := tree.consistencyProof(first, second)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"consistency": hashes(proof)})
+}
+
+// LogEntry is a leaf of the log: a line of the history, exactly as hashed,
+// and the observation it holds.
+type LogEntry struct {
+	Index       int          `json:"index"`
+	LeafInput   []byte       `json:"leaf_input"`
+	Observation *Observation `json:"observation,omitempty"`
+}
+
+// LogEntriesHandler returns the entries from start to end, inclusive, or
+// as many as we return at once.
+func LogEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := logRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_, offsets, size := h.snapshot()
+	start, err := formInt(r, "start", 0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	end, err := formInt(r, "end", len(offsets)-1)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if end >= len(offsets) {
+		end = len(offsets) - 1
+	}
+	if end >= start+maxLogEntries {
+		end = start + maxLogEntries - 1
+	}
+	if start > end {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("no entries from %d to %d, the log has %d", start, end, len(offsets))))
+		return
+	}
+
+	entries := []LogEntry{}
+	for i := start; i <= end; i++ {
+		next := size
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		line := make([]byte, next-offsets[i]-1)
+		if _, err := h.file.ReadAt(line, offsets[i]); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		e := LogEntry{Index: i, LeafInput: line, Observation: new(Observation)}
+		if json.Unmarshal(line, e.Observation) != nil {
+			e.Observation = nil
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, map[string]interface{}{"entries": entries})
+}
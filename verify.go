@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+)
+
+// Verification is the result of hashing an artifact and comparing it to
+// the digests published for it.
+type Verification struct {
+	Artifact  string            `json:"artifact"`
+	Filename  string            `json:"filename,omitempty"`
+	Algorithm string            `json:"algorithm,omitempty"`
+	Expected  string            `json:"expected,omitempty"`
+	Actual    string            `json:"actual,omitempty"`
+	Match     bool              `json:"match"`
+	Checked   []string          `json:"checked,omitempty"`
+	Digests   map[string]string `json:"digests,omitempty"`
+	Bytes     int64             `json:"bytes"`
+	FinalURL  string            `json:"final_url,omitempty"`
+	Redirects []Hop             `json:"redirects,omitempty"`
+	Signature *Signature        `json:"signature,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// maxminisignsize is the largest artifact we will hold in memory to check a
+// legacy (not prehashed) minisign signature over it.
+const maxminisignsize = 16 << 20
+
+// legacySlots bounds how many artifacts are held in memory for legacy
+// minisign signatures at once, whatever asked for them.
+var legacySlots = make(chan struct{}, 2)
+
+// selectEntries returns the entries describing the file called name that
+// we can compute, strongest algorithm first, leaving out those extracted
+// from a page with less than minConfidence. A checksum file holding a
+// single bare hash describes whatever file it was published for.
+func selectEntries(entries []Entry, name string) []Entry {
+	var usable, found []Entry
+	for _, e := range entries {
+		if e.Confidence == 0 || e.Confidence >= minConfidence {
+			usable = append(usable, e)
+		}
+	}
+	for _, e := range usable {
+		if newHash(e.Algorithm) == nil {
+			continue
+		}
+		if (len(usable) == 1 && e.Filename == "") || e.Filename == name || path.Base(e.Filename) == name {
+			found = append(found, e)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return strength(found[i].Algorithm) < strength(found[j].Algorithm)
+	})
+	return found
+}
+
+// verifyArtifact streams the artifact at u through apigun within d,
+// computing every digest published for it plus any extra algorithms in a
+// single pass, and compares the results to the matching entries. If
+// minisigfile is not nil, the artifact must also carry that minisign
+// signature; sigerr is why it could not be fetched, which fails the match
+// the same as a bad signature.
+func verifyArtifact(ctx context.Context, d Deadlines, policy RedirectPolicy, u *url.URL, entries []Entry, extra []string, minisigfile []byte, sigerr error) *Verification {
+	v := &Verification{Artifact: u.String()}
+	if sigerr != nil {
+		v.Signature = &Signature{Scheme: "minisign", Error: sigerr.Error()}
+	}
+
+	name := path.Base(u.Path)
+	matched := selectEntries(entries, name)
+	if len(matched) == 0 && len(extra) == 0 && minisigfile == nil && sigerr == nil {
+		v.Error = fmt.Sprintf("no usable entry for %q", name)
+		return v
+	}
+
+	algs := append([]string{}, extra...)
+	for _, e := range matched {
+		algs = append(algs, e.Algorithm)
+	}
+
+	// A prehashed minisign signature needs the BLAKE2b-512 digest, a legacy
+	// one needs the whole artifact.
+	var sig *minisig
+	var legacy *bytes.Buffer
+	if minisigfile != nil {
+		var err error
+		if sig, err = parseMinisig(minisigfile); err != nil {
+			v.Signature = &Signature{Scheme: "minisign", Error: err.Error()}
+		} else if sig.prehashed() {
+			algs = append(algs, "BLAKE2B")
+		} else {
+			legacy = new(bytes.Buffer)
+		}
+	}
+
+	h, err := NewHasher(algs...)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+
+	release := func() {}
+	defer func() { release() }()
+	if legacy != nil {
+		select {
+		case legacySlots <- struct{}{}:
+			release = func() { <-legacySlots }
+		case <-ctx.Done():
+			v.Error = fetchErr(ctx, ctx.Err()).Error()
+			return v
+		}
+	}
+
+	ctx, rd := trackRedirects(ctx, policy)
+	resp, err := get(ctx, u, d)
+	v.Redirects = rd.Hops()
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	defer resp.Body.Close()
+	v.FinalURL = resp.Request.URL.String()
+	if resp.StatusCode != http.StatusOK {
+		v.Error = "artifact: " + resp.Status
+		return v
+	}
+
+	var body io.Reader = countProgress(ctx, resp.Body, resp.ContentLength)
+	if legacy != nil && resp.ContentLength <= maxminisignsize {
+		body = io.TeeReader(body, &limitedBuffer{legacy, maxminisignsize})
+	} else {
+		// Known to be too large, or not buffered at all: free the slot now
+		release()
+		release = func() {}
+	}
+	v.Bytes, err = h.ReadFrom(body)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.Digests = h.Sums()
+
+	if sig != nil {
+		if legacy != nil && int64(legacy.Len()) < v.Bytes {
+			v.Signature = &Signature{Scheme: "minisign", Error: fmt.Sprintf("artifact too large for a legacy signature (%d bytes max)", maxminisignsize)}
+		} else if legacy != nil {
+			v.Signature = sig.verify(u.Hostname(), legacy.Bytes())
+		} else {
+			digest, _ := hex.DecodeString(v.Digests["BLAKE2B"])
+			v.Signature = sig.verify(u.Hostname(), digest)
+		}
+	}
+
+	if len(matched) == 0 {
+		if sig == nil {
+			v.Error = fmt.Sprintf("no usable entry for %q", name)
+		}
+		v.Match = v.Signature != nil && v.Signature.Valid
+		return v
+	}
+	best := matched[0]
+	v.Filename, v.Algorithm, v.Expected = best.Filename, best.Algorithm, best.Digest
+	v.Actual = v.Digests[best.Algorithm]
+
+	// Every digest published for the file must agree, not just the best one.
+	v.Match = v.Signature == nil || v.Signature.Valid
+	for _, e := range matched {
+		v.Checked = append(v.Checked, e.Algorithm)
+		if v.Digests[e.Algorithm] != e.Digest {
+			v.Match = false
+		}
+	}
+	return v
+}
+
+// limitedBuffer keeps at most n bytes written to it and quietly drops the
+// rest, so a stream can be teed into it without failing.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.n - int64(b.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		file    string
+		want    []string // algorithms, in order
+	}{
+		{"strongest first", []Entry{{"MD5", "foo.zip", md5foo, 1, 0}, {"SHA256", "dist/foo.zip", sha256foo, 2, 0}, {"SHA1", "foo.zip", sha1foo, 3, 0}}, "foo.zip", []string{"SHA256", "SHA1", "MD5"}},
+		{"other files", []Entry{{"SHA256", "bar.zip", sha256foo, 1, 0}}, "foo.zip", nil},
+		{"lone bare hash", []Entry{{Algorithm: "SHA256", Digest: sha256foo, Line: 1}}, "foo.zip", []string{"SHA256"}},
+		{"unknown algorithm", []Entry{{"WHIRLPOOL", "foo.zip", sha256foo, 1, 0}}, "foo.zip", nil},
+		{"confident", []Entry{{Algorithm: "SHA256", Filename: "foo.zip", Digest: sha256foo, Confidence: 0.7}}, "foo.zip", []string{"SHA256"}},
+		{"not confident", []Entry{
+			{Algorithm: "SHA256", Filename: "foo.zip", Digest: sha256foo, Confidence: 0.7},
+			{Algorithm: "MD5", Filename: "foo.zip", Digest: md5foo, Confidence: 0.4},
+		}, "foo.zip", []string{"SHA256"}},
+		{"not confident, bare", []Entry{{Algorithm: "MD5", Digest: md5foo, Confidence: 0.4}}, "foo.zip", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range selectEntries(tt.entries, tt.file) {
+				got = append(got, e.Algorithm)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}